@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Admin endpoints exposing node internals, registered with APIServer.AddHandler
+
+func (n *Node) repairStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if n.Repairs == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(CLUSTER_NOT_STABLE))
+		return
+	}
+	writeJSON(w, n.Repairs.Status())
+}
+
+// OwnershipReport is the response of the ownership endpoint
+type OwnershipReport struct {
+	Current   map[string]*Ownership `json:"current"`
+	Projected map[string]*Ownership `json:"projected,omitempty"`
+}
+
+// ownershipHandler reports the share of the keyspace of every node and, given
+// a node and weight, the shares projected after changing that node's weight
+func (n *Node) ownershipHandler(w http.ResponseWriter, r *http.Request) {
+	if n.Router == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(CLUSTER_NOT_STABLE))
+		return
+	}
+	report := OwnershipReport{Current: n.Router.GetOwnership()}
+	node := r.URL.Query().Get("node")
+	if node != "" {
+		weight, err := strconv.ParseFloat(r.URL.Query().Get("weight"), 64)
+		if err != nil || weight <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("weight must be a positive number"))
+			return
+		}
+		report.Projected, err = ProjectOwnership(n.Config, node, weight)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	writeJSON(w, report)
+}
+
+// weightHandler changes the weight of a node, which moves its ranges in the
+// background before the weight takes effect
+func (n *Node) weightHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if n.Config == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(CLUSTER_NOT_STABLE))
+		return
+	}
+	node := r.URL.Query().Get("node")
+	weight, err := strconv.ParseFloat(r.URL.Query().Get("weight"), 64)
+	if err != nil || weight <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("weight must be a positive number"))
+		return
+	}
+	err = n.SetWeight(node, weight)
+	if err != nil {
+		if err.Error() == NODE_NOT_FOUND {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusConflict)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("changing weight of " + node + " to " + strconv.FormatFloat(weight, 'g', -1, 64)))
+}
+
+// decommissionHandler starts removing this node from the cluster, the node
+// shuts down once its ranges are handed off
+func (n *Node) decommissionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if n.Config == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(CLUSTER_NOT_STABLE))
+		return
+	}
+	err := n.Decommission()
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("decommissioning " + n.Info.Name))
+}
+
+// ClusterNode is a member of the cluster as seen by the node answering
+type ClusterNode struct {
+	Name      string     `json:"name"`
+	Addr      string     `json:"addr"`
+	Port      string     `json:"port"`
+	Zone      string     `json:"zone"`
+	Weight    float64    `json:"weight"`
+	NewWeight float64    `json:"new_weight,omitempty"` // while the weight changes
+	Status    NodeStatus `json:"status"`
+	Liveness  Liveness   `json:"liveness"`
+	Meta      *NodeMeta  `json:"meta"` // nil until the node advertised metadata
+}
+
+// ClusterReport is the response of the cluster endpoint
+type ClusterReport struct {
+	Epoch uint64        `json:"epoch"`
+	Nodes []ClusterNode `json:"nodes"`
+}
+
+// clusterHandler lists every node of the cluster with its advertised metadata
+func (n *Node) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if n.Router == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(CLUSTER_NOT_STABLE))
+		return
+	}
+	report := ClusterReport{Epoch: n.Config.Epoch}
+	for _, node := range n.Config.Nodes {
+		status := node.Status
+		if status == "" {
+			status = NORMAL
+		}
+		report.Nodes = append(report.Nodes, ClusterNode{
+			Name:      node.Name,
+			Addr:      node.Addr,
+			Port:      node.Port,
+			Zone:      node.Zone,
+			Weight:    node.Weight,
+			NewWeight: node.NewWeight,
+			Status:    status,
+			Liveness:  n.Liveness.Get(node),
+			Meta:      n.Router.GetNodeMeta(node.Name),
+		})
+	}
+	writeJSON(w, report)
+}
+
+// failureDetectorHandler reports the phi accrual state of every other node
+func (n *Node) failureDetectorHandler(w http.ResponseWriter, r *http.Request) {
+	if n.Config == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(CLUSTER_NOT_STABLE))
+		return
+	}
+	report := make(map[string]PeerPhi)
+	for _, node := range n.Config.Nodes {
+		if node.Name != n.Info.Name {
+			report[node.Name] = n.Failures.Stats(node.Name)
+		}
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+)
+
+// BadgerStorage is a StorageEngine persisting to a badger database
+type BadgerStorage struct {
+	db *badger.DB
+}
+
+func OpenBadgerStorage(dir string, o BadgerOptions) *BadgerStorage {
+	opts := badger.DefaultOptions(dir).
+		WithSyncWrites(o.SyncWrites).
+		WithValueLogFileSize(o.ValueLogFileSize << 20).
+		WithBlockCacheSize(o.BlockCacheSize << 20).
+		WithCompression(badgerCompression[o.Compression]).
+		WithMemTableSize(o.MemTableSize << 20)
+	if o.InMemory {
+		opts = opts.WithDir("").WithValueDir("").WithInMemory(true)
+	}
+	db, err := badger.Open(opts)
+	if err != nil {
+		panic(err)
+	}
+	return &BadgerStorage{db: db}
+}
+
+var badgerCompression = map[string]options.CompressionType{
+	"NONE":   options.None,
+	"SNAPPY": options.Snappy,
+	"ZSTD":   options.ZSTD,
+}
+
+func (s *BadgerStorage) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		value, err = badgerGet(txn, key)
+		return err
+	})
+	return value, err
+}
+
+func (s *BadgerStorage) Put(key, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+func (s *BadgerStorage) Delete(key []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (s *BadgerStorage) Batch(ops []BatchOp) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, op := range ops {
+			var err error
+			if op.Delete {
+				err = txn.Delete(op.Key)
+			} else {
+				err = txn.Set(op.Key, op.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BadgerStorage) Iterate(r KeyRange, f func(key, value []byte) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		return badgerIterate(txn, r, f)
+	})
+}
+
+func (s *BadgerStorage) Snapshot() (StorageSnapshot, error) {
+	return &badgerSnapshot{txn: s.db.NewTransaction(false)}, nil
+}
+
+func (s *BadgerStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *BadgerStorage) Stats() EngineStats {
+	var stats EngineStats
+	for _, table := range s.db.Tables() {
+		stats.Keys += uint64(table.KeyCount)
+	}
+	stats.LSMBytes, stats.VLogBytes = s.db.Size()
+	return stats
+}
+
+// badgerSnapshot is a read only badger transaction
+type badgerSnapshot struct {
+	txn *badger.Txn
+}
+
+func (s *badgerSnapshot) Get(key []byte) ([]byte, error) {
+	return badgerGet(s.txn, key)
+}
+
+func (s *badgerSnapshot) Iterate(r KeyRange, f func(key, value []byte) error) error {
+	return badgerIterate(s.txn, r, f)
+}
+
+func (s *badgerSnapshot) Release() {
+	s.txn.Discard()
+}
+
+func badgerGet(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func badgerIterate(txn *badger.Txn, r KeyRange, f func(key, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = !r.KeysOnly
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(r.Start); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.KeyCopy(nil)
+		if r.End != nil && bytes.Compare(key, r.End) >= 0 {
+			break
+		}
+		var value []byte
+		if !r.KeysOnly {
+			var err error
+			value, err = item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+		}
+		err := f(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
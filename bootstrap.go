@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// onConfigChange starts the bootstrap, handoff or weight change of this node
+// if its config entry requires one, which resumes it after a restart
+func (n *Node) onConfigChange() {
+	// Our status may have changed
+	go n.advertiseMeta()
+	self := n.Config.GetNode(n.Info.Name)
+	if self == nil || (self.Status != JOINING && self.Status != LEAVING && self.NewWeight == 0) {
+		return
+	}
+	n.mu.Lock()
+	if n.moving {
+		n.mu.Unlock()
+		return
+	}
+	n.moving = true
+	n.mu.Unlock()
+	switch self.Status {
+	case JOINING:
+		go n.Bootstrap()
+	case LEAVING:
+		go n.handoff()
+	default:
+		go n.reweight()
+	}
+}
+
+// AdmitNode adds a node to the cluster as JOINING, nodes already in the
+// config are left as they are. A node replacing a dead one takes over its
+// tokens, weight and zone so it ends up at exactly the same ring position.
+func (n *Node) AdmitNode(ni *NodeInfo) error {
+	if n.Config.GetNode(ni.Name) != nil {
+		return nil
+	}
+	if ni.Replaces != "" {
+		dead := n.Config.GetNode(ni.Replaces)
+		if dead == nil {
+			return errors.New(NODE_NOT_FOUND)
+		}
+		if n.MList.CheckIfNodeAlive(dead) {
+			return errors.New(NODE_NOT_DEAD)
+		}
+	}
+	return n.UpdateConfig(func(cfg *Config) error {
+		if cfg.GetNode(ni.Name) != nil {
+			return nil
+		}
+		joining := *ni
+		joining.Tokens = nil
+		joining.Status = JOINING
+		if ni.Replaces != "" {
+			dead := cfg.GetNode(ni.Replaces)
+			if dead == nil {
+				return errors.New(NODE_NOT_FOUND)
+			}
+			joining.Tokens = dead.Tokens
+			joining.Weight = dead.Weight
+			joining.Zone = dead.Zone
+			log.Infof("Admitting %s to the cluster in place of %s", ni.Name, ni.Replaces)
+		} else {
+			log.Infof("Admitting %s to the cluster", ni.Name)
+		}
+		cfg.Nodes = append(cfg.Nodes, &joining)
+		return nil
+	})
+}
+
+// CompleteJoin makes a joining node the owner of its ranges, removing the
+// node it replaces if any
+func (n *Node) CompleteJoin(name string) error {
+	self := n.Config.GetNode(name)
+	if self == nil {
+		return errors.New(NODE_NOT_FOUND)
+	}
+	if self.Status != JOINING {
+		return nil
+	}
+	return n.UpdateConfig(func(cfg *Config) error {
+		node := cfg.GetNode(name)
+		if node == nil {
+			return errors.New(NODE_NOT_FOUND)
+		}
+		if node.Status != JOINING {
+			return nil
+		}
+		node.Status = NORMAL
+		if node.Replaces != "" {
+			for i, dead := range cfg.Nodes {
+				if dead.Name == node.Replaces {
+					cfg.Nodes = append(cfg.Nodes[:i], cfg.Nodes[i+1:]...)
+					break
+				}
+			}
+			log.Infof("%s replaced %s", name, node.Replaces)
+			node.Replaces = ""
+		}
+		log.Infof("%s joined the cluster", name)
+		return nil
+	})
+}
+
+// Bootstrap streams every range this node will replicate from its current
+// replicas, then asks the seed to make this node an owner. Writes reach this
+// node as a pending replica meanwhile, so nothing is missed.
+func (n *Node) Bootstrap() {
+	n.streamGainedRanges()
+	for {
+		self := n.Config.GetNode(n.Info.Name)
+		if self == nil {
+			// Our admission lost against a concurrent config change
+			n.RequestJoin(n.seed)
+		} else if self.Status == JOINING {
+			n.RequestJoinComplete(n.seed)
+		} else {
+			break
+		}
+		time.Sleep(BootstrapRetryInterval)
+	}
+	n.mu.Lock()
+	n.moving = false
+	n.mu.Unlock()
+}
+
+// streamGainedRanges streams every range this node replicates once the
+// pending changes complete but not yet, retrying until each one arrived
+func (n *Node) streamGainedRanges() {
+	sources := n.Router.GetBootstrapSources(n.Info.Name)
+	log.Infof("Streaming %d ranges", len(sources))
+	for hr, nodes := range sources {
+		for {
+			err := n.streamRangeFrom(hr, nodes)
+			if err == nil {
+				break
+			}
+			log.Warnf("Could not stream range %s: %s", merkleRangeID(hr), err)
+			time.Sleep(BootstrapRetryInterval)
+		}
+	}
+	log.Infof("Streamed all ranges")
+}
+
+// streamRangeFrom streams a range from the first of nodes that succeeds
+func (n *Node) streamRangeFrom(hr HashRange, nodes []*NodeInfo) error {
+	err := errors.New(NODE_UNREACHABLE)
+	for _, node := range nodes {
+		err = n.streamRange(hr, node.Name)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *Node) streamRange(hr HashRange, from string) error {
+	reqID, respChan := n.registerRequest(1)
+	defer n.unregisterRequest(reqID)
+	err := n.RequestStream(reqID, hr, from)
+	if err != nil {
+		return err
+	}
+	select {
+	case resp := <-respChan:
+		var respMsg StreamRequestMsg
+		err := json.Unmarshal(resp.Msg, &respMsg)
+		if err != nil {
+			return err
+		}
+		if respMsg.Error != "" {
+			return errors.New(respMsg.Error)
+		}
+		log.Infof("Received %d keys of range %s from %s", respMsg.Keys, merkleRangeID(hr), from)
+		return nil
+	case <-time.After(StreamTimeout):
+		return errors.New(STREAM_TIMEOUT)
+	}
+}
+
+// StreamRange sends every key in hr to another node, waiting for each key to
+// be acknowledged, and returns the number of keys sent
+func (n *Node) StreamRange(hr HashRange, to string) (int, error) {
+	keys := 0
+	err := n.Engine.StreamRange(hr, func(key string, rec *Record) error {
+		n.limiter.Wait()
+		err := n.RepairKey(key, rec, to)
+		if err != nil {
+			return err
+		}
+		keys++
+		return nil
+	})
+	return keys, err
+}
+
+// RepairKey sends a record to another node and waits until it was applied
+func (n *Node) RepairKey(key string, rec *Record, to string) error {
+	reqID, ackChan := n.registerRequest(1)
+	defer n.unregisterRequest(reqID)
+	err := n.RequestRepair(reqID, key, rec, to)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ackChan:
+		return nil
+	case <-time.After(RepairTimeout):
+		return errors.New(REPAIR_TIMEOUT)
+	}
+}
+
+const (
+	BootstrapRetryInterval = 1 * time.Second
+	StreamTimeout          = 30 * time.Minute
+	MemberWaitTimeout      = 10 * time.Second
+	ConfigSettleInterval   = 3 * time.Second
+)
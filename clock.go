@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Timestamp is a hybrid logical clock reading. Timestamps are ordered by
+// physical time, then by logical counter and finally by node ID so that two
+// distinct writes never tie.
+type Timestamp struct {
+	WallTime int64  `json:"wall_time"` // physical time in milliseconds
+	Logical  uint32 `json:"logical"`
+	NodeID   string `json:"node_id"` // 8 character padded node name
+}
+
+// Compare returns -1, 0 or 1 if t is before, equal to or after o
+func (t Timestamp) Compare(o Timestamp) int {
+	switch {
+	case t.WallTime < o.WallTime:
+		return -1
+	case t.WallTime > o.WallTime:
+		return 1
+	case t.Logical < o.Logical:
+		return -1
+	case t.Logical > o.Logical:
+		return 1
+	case t.NodeID < o.NodeID:
+		return -1
+	case t.NodeID > o.NodeID:
+		return 1
+	}
+	return 0
+}
+
+func (t Timestamp) Less(o Timestamp) bool {
+	return t.Compare(o) < 0
+}
+
+func (t Timestamp) IsZero() bool {
+	return t.WallTime == 0 && t.Logical == 0 && t.NodeID == ""
+}
+
+// Encode returns a fixed width representation of TimestampLen characters
+func (t Timestamp) Encode() string {
+	return fmt.Sprintf("%016x%08x", t.WallTime, t.Logical) + PadName(t.NodeID)
+}
+
+func DecodeTimestamp(s string) (Timestamp, error) {
+	if len(s) != TimestampLen {
+		return Timestamp{}, errors.New(INVALID_TIMESTAMP)
+	}
+	wall, err := strconv.ParseInt(s[:16], 16, 64)
+	if err != nil {
+		return Timestamp{}, err
+	}
+	logical, err := strconv.ParseUint(s[16:24], 16, 32)
+	if err != nil {
+		return Timestamp{}, err
+	}
+	return Timestamp{
+		WallTime: wall,
+		Logical:  uint32(logical),
+		NodeID:   s[24:],
+	}, nil
+}
+
+// HLC is a hybrid logical clock
+type HLC struct {
+	nodeID string
+	last   Timestamp
+	mu     sync.Mutex
+}
+
+func NewHLC(nodeID string) *HLC {
+	return &HLC{nodeID: PadName(nodeID)}
+}
+
+func physicalTime() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Now returns a timestamp greater than any previously returned or observed
+func (c *HLC) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pt := physicalTime()
+	if pt > c.last.WallTime {
+		c.last.WallTime = pt
+		c.last.Logical = 0
+	} else {
+		c.last.Logical++
+	}
+	c.last.NodeID = c.nodeID
+	return c.last
+}
+
+// Update merges a timestamp received from another node into the clock
+func (c *HLC) Update(remote Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pt := physicalTime()
+	if remote.WallTime-pt > MaxClockOffset.Milliseconds() {
+		log.Warnf("Ignoring timestamp from %s which is %dms ahead", remote.NodeID, remote.WallTime-pt)
+		return
+	}
+	switch {
+	case pt > c.last.WallTime && pt > remote.WallTime:
+		c.last.WallTime = pt
+		c.last.Logical = 0
+	case remote.WallTime > c.last.WallTime:
+		c.last.WallTime = remote.WallTime
+		c.last.Logical = remote.Logical + 1
+	case c.last.WallTime > remote.WallTime:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+	c.last.NodeID = c.nodeID
+}
+
+const (
+	TimestampLen   = 32
+	MaxClockOffset = 500 * time.Millisecond
+)
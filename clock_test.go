@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHLCMonotonic(t *testing.T) {
+	now := physicalTime()
+	tests := []struct {
+		name   string
+		remote Timestamp
+		ahead  bool // the next timestamp must follow remote
+	}{
+		{"remote behind", Timestamp{WallTime: now - 1000, Logical: 7, NodeID: PadName("n7002")}, true},
+		{"remote ahead", Timestamp{WallTime: now + 200, Logical: 3, NodeID: PadName("n7002")}, true},
+		{"remote same time", Timestamp{WallTime: now, Logical: 1 << 20, NodeID: PadName("n7002")}, true},
+		{"remote too far ahead", Timestamp{WallTime: now + 10*MaxClockOffset.Milliseconds(), NodeID: PadName("n7002")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewHLC("n7001")
+			prev := c.Now()
+			c.Update(tt.remote)
+			next := c.Now()
+			if !prev.Less(next) {
+				t.Fatalf("%v is not after %v", next, prev)
+			}
+			if tt.ahead && !tt.remote.Less(next) {
+				t.Fatalf("%v is not after the observed %v", next, tt.remote)
+			}
+			if !tt.ahead && tt.remote.Less(next) {
+				t.Fatalf("%v followed a timestamp that should have been ignored", next)
+			}
+			for i := 0; i < 1000; i++ {
+				ts := c.Now()
+				if !next.Less(ts) {
+					t.Fatalf("%v is not after %v", ts, next)
+				}
+				next = ts
+			}
+		})
+	}
+}
+
+func TestTimestampEncoding(t *testing.T) {
+	tests := []Timestamp{
+		{},
+		{WallTime: 1, Logical: 2, NodeID: PadName("n7001")},
+		{WallTime: physicalTime(), Logical: 1<<32 - 1, NodeID: PadName("n7001")},
+	}
+	for _, ts := range tests {
+		decoded, err := DecodeTimestamp(ts.Encode())
+		if err != nil {
+			t.Fatalf("decoding %v failed: %s", ts, err)
+		}
+		if ts.NodeID == "" {
+			ts.NodeID = PadName("")
+		}
+		if decoded != ts {
+			t.Fatalf("decoded %v, want %v", decoded, ts)
+		}
+	}
+}
@@ -1,17 +1,41 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
 
-// Config is configuration shared by all nodes in the cluster
+// Config is configuration shared by all nodes in the cluster. An installed
+// config is never modified, changes go through UpdateConfig so every node
+// ends up with the same version. Node local state belongs in the Node.
 type Config struct {
-	ReplicationFactor ReplicationFactor `json:"replication_factor"`
-	ConsistencyLevel  ConsistencyLevel  `json:"consistency_level"`
-	MinReadsRequired  int               `json:"min_reads_required"`
-	MinWritesRequired int               `json:"min_writes_required"`
-	Nodes             []*NodeInfo       `json:"nodes"`
-	State             ClusterState      `json:"state"`
+	Epoch             uint64                `json:"epoch"` // incremented by every membership change
+	ReplicationFactor ReplicationFactor     `json:"replication_factor"`
+	ConsistencyLevel  ConsistencyLevel      `json:"consistency_level"`
+	MinReadsRequired  int                   `json:"min_reads_required"`
+	MinWritesRequired int                   `json:"min_writes_required"`
+	Nodes             []*NodeInfo           `json:"nodes"`
+	VNodes            int                   `json:"vnodes"` // tokens per node
+	Placement         PlacementStrategy     `json:"placement"`
+	Keyspaces         map[string]Versioning `json:"keyspaces"`
+	MerkleDepth       int                   `json:"merkle_depth"`
+	RepairInterval    time.Duration         `json:"repair_interval"`
+	RepairConcurrency int                   `json:"repair_concurrency"`
+	RepairKeysPerSec  int                   `json:"repair_keys_per_sec"` // 0 means unlimited
+	ReadRepair        ReadRepairMode        `json:"read_repair"`
+	ReadRepairWaitAll bool                  `json:"read_repair_wait_all"` // keep reading from all replicas after quorum
+	HintTTL           time.Duration         `json:"hint_ttl"`
+	MaxHintsPerNode   int                   `json:"max_hints_per_node"`
+	PhiThreshold      float64               `json:"phi_threshold"`   // replicas suspected above it are avoided, 0 disables
+	TombstoneGrace    time.Duration         `json:"tombstone_grace"` // minimum age of purged tombstones, 0 keeps them forever
 }
 
+const (
+	DefaultVNodes = 16
+)
+
 type ReplicationFactor int
 
 const (
@@ -25,15 +49,52 @@ type ConsistencyLevel int
 const (
 	QUORUM ConsistencyLevel = iota
 	ALL
+	LOCAL_QUORUM // Quorum of the replicas in the coordinator's zone
 )
 
-type ClusterState string
+func ParseConsistencyLevel(s string) (ConsistencyLevel, bool) {
+	switch s {
+	case "QUORUM":
+		return QUORUM, true
+	case "ALL":
+		return ALL, true
+	case "LOCAL_QUORUM":
+		return LOCAL_QUORUM, true
+	}
+	return 0, false
+}
+
+// PlacementStrategy decides which nodes hold the replicas of a range
+type PlacementStrategy string
 
 const (
-	STABLE   ClusterState = "STABLE"   // General state
-	UNSTABLE ClusterState = "UNSTABLE" // Unstable state
+	SIMPLE     PlacementStrategy = "SIMPLE"     // Next distinct nodes clockwise
+	ZONE_AWARE PlacementStrategy = "ZONE_AWARE" // Next nodes clockwise in distinct zones where possible
 )
 
+// Versioning decides how concurrent writes to a key are reconciled
+type Versioning string
+
+const (
+	LWW          Versioning = "LWW"          // Last writer wins by timestamp
+	VECTOR_CLOCK Versioning = "VECTOR_CLOCK" // Concurrent writes are kept as siblings
+)
+
+// KeyspaceOf returns the part of the key before the first ':', or "" if there is none
+func KeyspaceOf(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+func (c *Config) VersioningFor(key string) Versioning {
+	if v, ok := c.Keyspaces[KeyspaceOf(key)]; ok {
+		return v
+	}
+	return LWW
+}
+
 func CreateConfig(replicationFactor ReplicationFactor, consistencyLevel ConsistencyLevel, nodes []*NodeInfo) *Config {
 	var minReadsRequired, minWritesRequired int
 
@@ -45,7 +106,7 @@ func CreateConfig(replicationFactor ReplicationFactor, consistencyLevel Consiste
 		panic("Replication factor must be greater than 0")
 	}
 
-	if consistencyLevel == QUORUM {
+	if consistencyLevel == QUORUM || consistencyLevel == LOCAL_QUORUM {
 		minReadsRequired = int(replicationFactor)/2 + 1
 		minWritesRequired = int(replicationFactor)/2 + 1
 	} else if consistencyLevel == ALL {
@@ -61,10 +122,64 @@ func CreateConfig(replicationFactor ReplicationFactor, consistencyLevel Consiste
 		MinReadsRequired:  minReadsRequired,
 		MinWritesRequired: minWritesRequired,
 		Nodes:             nodes,
-		State:             UNSTABLE,
+		VNodes:            DefaultVNodes,
+		Placement:         SIMPLE,
+		Keyspaces:         make(map[string]Versioning),
+		MerkleDepth:       DefaultMerkleDepth,
+		RepairInterval:    DefaultRepairInterval,
+		RepairConcurrency: DefaultRepairConcurrency,
+		RepairKeysPerSec:  DefaultRepairKeysPerSecond,
+		ReadRepair:        ASYNC_READ_REPAIR,
+		HintTTL:           DefaultHintTTL,
+		MaxHintsPerNode:   DefaultMaxHintsPerNode,
+		PhiThreshold:      DefaultPhiThreshold,
+		TombstoneGrace:    DefaultTombstoneGrace,
 	}
 }
 
+// AssignTokens gives every node the number of tokens matching its weight.
+// It is applied to configs before they are installed, see NodeInfo.AssignTokens.
+func (c *Config) AssignTokens() {
+	for _, node := range c.Nodes {
+		node.AssignTokens(node.TokenCount(c.VNodes))
+	}
+}
+
+// GetNode returns the entry of the named node, nil if it is not a member
+func (c *Config) GetNode(name string) *NodeInfo {
+	for _, node := range c.Nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// ConfigVersion identifies a config. Configs are ordered by epoch, configs
+// changed concurrently under the same epoch by their digest, so every node
+// picks the same one.
+type ConfigVersion struct {
+	Epoch  uint64 `json:"epoch"`
+	Digest string `json:"digest"`
+}
+
+func (c *Config) Version() ConfigVersion {
+	return ConfigVersion{Epoch: c.Epoch, Digest: hex.EncodeToString([]byte(GenerateHash(string(c.SerializeConfig()))))}
+}
+
+// Newer reports whether v supersedes o
+func (v ConfigVersion) Newer(o ConfigVersion) bool {
+	if v.Epoch != o.Epoch {
+		return v.Epoch > o.Epoch
+	}
+	return v.Digest > o.Digest
+}
+
+// Copy returns a deep copy that can be changed without affecting c
+func (c *Config) Copy() *Config {
+	return DeserializeConfig(c.SerializeConfig())
+}
+
 func (c *Config) SerializeConfig() []byte {
 	b, err := json.Marshal(c)
 	if err != nil {
@@ -79,5 +194,10 @@ func DeserializeConfig(b []byte) *Config {
 	if err != nil {
 		panic(err)
 	}
+	// Configs written before the setting existed leave it 0, which would
+	// block every repair
+	if c.RepairConcurrency < 1 {
+		c.RepairConcurrency = DefaultRepairConcurrency
+	}
 	return c
 }
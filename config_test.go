@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDeserializeConfigDefaultsRepairConcurrency(t *testing.T) {
+	tests := []struct {
+		concurrency int
+		want        int
+	}{
+		{0, DefaultRepairConcurrency},
+		{-1, DefaultRepairConcurrency},
+		{1, 1},
+		{5, 5},
+	}
+	for _, tt := range tests {
+		cfg := CreateConfig(ONE, QUORUM, []*NodeInfo{{Name: "n7001"}})
+		cfg.RepairConcurrency = tt.concurrency
+		if got := DeserializeConfig(cfg.SerializeConfig()).RepairConcurrency; got != tt.want {
+			t.Errorf("repair concurrency %d loaded as %d, want %d", tt.concurrency, got, tt.want)
+		}
+	}
+}
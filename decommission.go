@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Decommission removes this node from the cluster. The node is marked
+// LEAVING, so writes also reach the nodes inheriting its ranges, and the
+// handoff started for that status streams each of its ranges to them before
+// the node leaves the config and shuts down.
+func (n *Node) Decommission() error {
+	err := n.UpdateConfig(func(cfg *Config) error {
+		self := cfg.GetNode(n.Info.Name)
+		if self == nil {
+			return errors.New(NODE_NOT_FOUND)
+		}
+		if self.Status != NORMAL && self.Status != "" {
+			return errors.New(NODE_NOT_NORMAL)
+		}
+		if self.NewWeight != 0 {
+			return errors.New(WEIGHT_CHANGING)
+		}
+		if len(cfg.Nodes) <= int(cfg.ReplicationFactor) {
+			return errors.New(NOT_ENOUGH_NODES)
+		}
+		self.Status = LEAVING
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Decommissioning %s", n.Info.Name)
+	return nil
+}
+
+// handoff streams every range to its inheritors, then removes this node from
+// the cluster. If the ranges can't be handed off the node stays.
+func (n *Node) handoff() {
+	err := n.handOffRanges()
+	if err != nil {
+		log.Errorf("Decommission of %s failed, it stays in the cluster: %s", n.Info.Name, err)
+		n.abortDecommission()
+		return
+	}
+	// Hints for other nodes would be lost with this node
+	for _, target := range n.Engine.HintTargets() {
+		n.ReplayHints(target)
+	}
+	n.leaveConfig()
+	log.Infof("%s left the cluster", n.Info.Name)
+	n.Shutdown()
+}
+
+// handOffRanges streams every range this node replicates to the nodes that
+// replicate it once the pending changes complete but not yet, until each one
+// acknowledged all keys. The targets are resolved again before every retry,
+// so targets removed or replaced meanwhile are dropped. It fails if some
+// target still did not acknowledge after HandoffAttempts.
+func (n *Node) handOffRanges() error {
+	handedOff := make(map[string]bool) // range and target pairs done
+	backoff := BootstrapRetryInterval
+	for attempt := 1; ; attempt++ {
+		targets := n.Router.GetHandoffTargets(n.Info.Name)
+		log.Infof("Handing off %d ranges", len(targets))
+		failed := 0
+		for hr, nodes := range targets {
+			for _, node := range nodes {
+				id := merkleRangeID(hr) + "/" + node.Name
+				if handedOff[id] {
+					continue
+				}
+				keys, err := n.StreamRange(hr, node.Name)
+				if err != nil {
+					log.Warnf("Could not hand off range %s to %s: %s", merkleRangeID(hr), node.Name, err)
+					failed++
+					continue
+				}
+				log.Infof("Handed off %d keys of range %s to %s", keys, merkleRangeID(hr), node.Name)
+				handedOff[id] = true
+			}
+		}
+		if failed == 0 {
+			return nil
+		}
+		if attempt == HandoffAttempts {
+			return fmt.Errorf("%s: %d ranges were not acknowledged", HANDOFF_FAILED, failed)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > HandoffMaxBackoff {
+			backoff = HandoffMaxBackoff
+		}
+	}
+}
+
+// abortDecommission makes this node NORMAL again after a failed handoff
+func (n *Node) abortDecommission() {
+	err := n.UpdateConfig(func(cfg *Config) error {
+		self := cfg.GetNode(n.Info.Name)
+		if self == nil {
+			return errors.New(NODE_NOT_FOUND)
+		}
+		if self.Status != LEAVING {
+			return errors.New(NODE_NOT_NORMAL)
+		}
+		self.Status = NORMAL
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Could not cancel the decommission: %s", err)
+	}
+	n.mu.Lock()
+	n.moving = false
+	n.mu.Unlock()
+}
+
+// leaveConfig removes this node from the config. The removal is lost if a
+// concurrent change wins under the same epoch, so the other nodes are asked
+// for their config before leaving and the removal is repeated until it stays.
+func (n *Node) leaveConfig() {
+	others := n.Config.Nodes
+	for {
+		err := n.UpdateConfig(func(cfg *Config) error {
+			for i, node := range cfg.Nodes {
+				if node.Name == n.Info.Name {
+					cfg.Nodes = append(cfg.Nodes[:i], cfg.Nodes[i+1:]...)
+					return nil
+				}
+			}
+			return errors.New(NODE_NOT_FOUND)
+		})
+		if err != nil {
+			// Already removed by a concurrent change
+			log.Infof("Not leaving the config: %s", err)
+		}
+		for _, node := range others {
+			if node.Name != n.Info.Name {
+				n.RequestConfig(node.Name)
+			}
+		}
+		time.Sleep(ConfigSettleInterval)
+		if n.Config.GetNode(n.Info.Name) == nil {
+			return
+		}
+		log.Warnf("Removal from the config was lost, leaving again")
+	}
+}
+
+// Shutdown stops the node's background work, leaves the member list and
+// closes the engine and API server
+func (n *Node) Shutdown() {
+	close(n.stop)
+	if n.Repairs != nil {
+		n.Repairs.Stop()
+	}
+	n.loops.Wait()
+	err := n.MList.Leave()
+	if err != nil {
+		log.Warnf("Could not leave the member list: %s", err)
+	}
+	err = n.Engine.Close()
+	if err != nil {
+		log.Warnf("Could not close the engine: %s", err)
+	}
+	n.Server.Stop()
+}
+
+const (
+	HandoffAttempts   = 8
+	HandoffMaxBackoff = 1 * time.Minute
+)
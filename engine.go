@@ -1,121 +1,427 @@
 package main
 
 import (
-	"sort"
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
 
-	badger "github.com/dgraph-io/badger/v4"
+	log "github.com/sirupsen/logrus"
 )
 
-// Storage Engine Interface
+// Engine keeps records, their Merkle trees and hints in a StorageEngine
 type Engine struct {
-	db *badger.DB
-	mt *MerkleTree
+	db       StorageEngine
+	trees    map[HashRange]*MerkleTree // live trees of the ranges this node replicates
+	building map[HashRange]*MerkleTree // changes to ranges whose tree is being built, see TrackRanges
+	depth    int
+	mu       sync.Mutex     // serializes writes so trees stay in step with the data
+	tracking sync.Mutex     // serializes TrackRanges
+	hints    map[string]int // number of stored hints per target
+	hintsMu  sync.Mutex
 }
 
-func CreateEngine(dir string) *Engine {
-	opts := badger.DefaultOptions("/tmp/badger/" + dir)
-	db, err := badger.Open(opts)
-	if err != nil {
+func CreateEngine(db StorageEngine) *Engine {
+	e := &Engine{
+		db:       db,
+		trees:    make(map[HashRange]*MerkleTree),
+		building: make(map[HashRange]*MerkleTree),
+		depth:    DefaultMerkleDepth,
+	}
+	if err := e.MigrateLegacyRecords(); err != nil {
 		panic(err)
 	}
-	return &Engine{
-		db: db,
+	e.hints = e.countHints()
+	return e
+}
+
+// Read returns the record stored for key, or nil if there is none
+func (e *Engine) Read(key string) (*Record, error) {
+	val, err := e.db.Get([]byte(key))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	return DecodeRecord(val)
+}
+
+func (e *Engine) Write(key string, rec *Record) error {
+	return e.update(key, EncodeRecord(rec))
+}
+
+func (e *Engine) Delete(key string) {
+	e.update(key, nil)
+}
+
+// update sets key to value, or deletes it if value is nil, and applies the
+// change to the live Merkle trees covering the key in the same batch
+func (e *Engine) update(key string, value []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.apply(key, value)
+}
+
+// PurgeIf deletes key if purge returns true for the record currently stored
+func (e *Engine) PurgeIf(key string, purge func(rec *Record) bool) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rec, err := e.Read(key)
+	if err != nil || rec == nil || !purge(rec) {
+		return false, err
+	}
+	return true, e.apply(key, nil)
+}
+
+// Merge stores the result of merge with the record currently stored for key,
+// unless it is nil or unchanged. The read and write are atomic, so concurrent
+// merges of the same key can't lose an update.
+func (e *Engine) Merge(key string, merge func(prev *Record) *Record) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prev, err := e.Read(key)
+	if err != nil {
+		return false, err
+	}
+	merged := merge(prev)
+	if merged == nil {
+		return false, nil
+	}
+	value := EncodeRecord(merged)
+	if prev != nil && bytes.Equal(EncodeRecord(prev), value) {
+		return false, nil
 	}
+	return true, e.apply(key, value)
 }
 
-func (e *Engine) Read(key string) (string, error) {
-	var value string
-	err := e.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+// apply is update without locking, the caller must hold e.mu
+func (e *Engine) apply(key string, value []byte) error {
+	keyHash := GenerateHash(key)
+	deltas := make(map[*MerkleTree]int)
+	delta := EmptyHash
+	old, err := e.db.Get([]byte(key))
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		delta = XorHashes(delta, kvHash(key, old))
+	}
+	ops := []BatchOp{{Key: []byte(key), Value: value, Delete: value == nil}}
+	if value != nil {
+		delta = XorHashes(delta, kvHash(key, value))
+	}
+	for hr, mt := range e.trees {
+		idx := GetMTLeafIndex(keyHash, mt.Root)
+		if idx == -1 {
+			continue
+		}
+		leafHash := XorHashes(mt.LeafNodes[idx].Hash, delta)
+		ops = append(ops, BatchOp{Key: merkleLeafKey(hr, idx), Value: []byte(leafHash)})
+		deltas[mt] = idx
+	}
+	err = e.db.Batch(ops)
+	if err != nil {
+		return err
+	}
+	for mt, idx := range deltas {
+		mt.UpdateLeaf(idx, delta)
+	}
+	for _, mt := range e.building {
+		if idx := GetMTLeafIndex(keyHash, mt.Root); idx != -1 {
+			mt.LeafNodes[idx].Hash = XorHashes(mt.LeafNodes[idx].Hash, delta)
+		}
+	}
+	return nil
+}
+
+// EngineStats are storage statistics of an engine
+type EngineStats struct {
+	Keys      uint64 `json:"keys"` // approximate, counts stored versions once flushed to disk
+	LSMBytes  int64  `json:"lsm_bytes"`
+	VLogBytes int64  `json:"vlog_bytes"`
+}
+
+func (e *Engine) Stats() EngineStats {
+	return e.db.Stats()
+}
+
+func (e *Engine) Close() error {
+	return e.db.Close()
+}
+
+// Stream calls f with every stored key and record of a snapshot, stopping
+// at the first error. Records that can't be decoded are skipped.
+func (e *Engine) Stream(f func(key string, rec *Record) error) error {
+	snap, err := e.db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return streamSnapshot(snap, f)
+}
+
+func streamSnapshot(snap StorageSnapshot, f func(key string, rec *Record) error) error {
+	return snap.Iterate(KeyRange{}, func(k, val []byte) error {
+		key := string(k)
+		if IsInternalKey(key) {
+			return nil
+		}
+		rec, err := DecodeRecord(val)
 		if err != nil {
-			return err
+			// One bad value must not stop repair or handoff of the others
+			log.Warnf("Skipping unreadable record for key=%s: %s", key, err)
+			return nil
 		}
-		err = item.Value(func(val []byte) error {
-			value = string(val)
+		return f(key, rec)
+	})
+}
+
+// MigrateLegacyRecords rewrites values stored as a timestamp prefix and value
+// text into the record envelope
+func (e *Engine) MigrateLegacyRecords() error {
+	var ops []BatchOp
+	err := e.db.Iterate(KeyRange{}, func(key, val []byte) error {
+		if IsInternalKey(string(key)) || !IsLegacyRecord(val) {
 			return nil
-		})
-		return err
+		}
+		rec, err := DecodeRecord(val)
+		if err != nil {
+			log.Warnf("Skipping unreadable legacy value for key=%s", key)
+			return nil
+		}
+		ops = append(ops, BatchOp{Key: key, Value: EncodeRecord(rec)})
+		return nil
 	})
-	if err != nil && err != badger.ErrKeyNotFound {
-		return "", err
-	} else if err == badger.ErrKeyNotFound {
-		return "", nil
+	if err != nil {
+		return err
+	}
+	if err := e.writeBatches(ops); err != nil {
+		return err
 	}
-	return value, nil
+	if migrated := len(ops); migrated > 0 {
+		log.Infof("Migrated %d legacy values to the record format", migrated)
+	}
+	return nil
 }
 
-func (e *Engine) Write(key, value string) error {
-	return e.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(key), []byte(value))
+// CreateMerkleTree builds a Merkle tree over all keys whose hash is in hashRange
+func (e *Engine) CreateMerkleTree(hashRange HashRange, depth int) *MerkleTree {
+	snap, err := e.db.Snapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+	return buildMerkleTree(snap, hashRange, depth)
+}
+
+func buildMerkleTree(snap StorageSnapshot, hashRange HashRange, depth int) *MerkleTree {
+	mt := CreateMerkleTree(hashRange, depth)
+	// iterate over all keys in the range and add them to the merkle tree
+	streamSnapshot(snap, func(key string, rec *Record) error {
+		keyHash := GenerateHash(key)
+		idx := GetMTLeafIndex(keyHash, mt.Root)
+		if idx == -1 {
+			return nil
+		}
+		leaf := mt.LeafNodes[idx]
+		leaf.Hash = XorHashes(leaf.Hash, kvHash(key, EncodeRecord(rec)))
+		return nil
 	})
+	mt.ComputeHashes()
+	return mt
 }
 
-func (e *Engine) Delete(key string) {
-	e.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(key))
+// TrackRanges keeps live Merkle trees for exactly the given ranges. Trees are
+// loaded from disk when a matching one was persisted, otherwise built by a scan.
+// Both read a snapshot without holding e.mu, writes made meanwhile are
+// collected in e.building and added to the tree before it goes live.
+func (e *Engine) TrackRanges(ranges []HashRange, depth int) {
+	e.tracking.Lock()
+	defer e.tracking.Unlock()
+	e.mu.Lock()
+	e.depth = depth
+	trees := make(map[HashRange]*MerkleTree, len(ranges))
+	var missing []HashRange
+	for _, hr := range ranges {
+		if mt, ok := e.trees[hr]; ok && mt.Depth == depth {
+			trees[hr] = mt
+			continue
+		}
+		missing = append(missing, hr)
+		e.building[hr] = CreateMerkleTree(hr, depth)
+	}
+	snap, err := e.db.Snapshot()
+	e.mu.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	for _, hr := range missing {
+		mt := loadMerkleTree(snap, hr, depth)
+		if mt == nil {
+			log.Infof("Building merkle tree for range %s", merkleRangeID(hr))
+			mt = buildMerkleTree(snap, hr, depth)
+		}
+		trees[hr] = mt
+	}
+	snap.Release()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, hr := range missing {
+		mt := trees[hr]
+		for idx, leaf := range e.building[hr].LeafNodes {
+			mt.LeafNodes[idx].Hash = XorHashes(mt.LeafNodes[idx].Hash, leaf.Hash)
+		}
+		mt.ComputeHashes()
+		delete(e.building, hr)
+		err := e.saveMerkleTree(hr, mt)
+		if err != nil {
+			panic(err)
+		}
+	}
+	e.trees = trees
+	err = e.dropUntrackedMerkleTrees()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// GetMerkleTree returns a copy of the live tree for hashRange, or builds one
+// if the range is not tracked
+func (e *Engine) GetMerkleTree(hashRange HashRange) *MerkleTree {
+	e.mu.Lock()
+	mt, ok := e.trees[hashRange]
+	depth := e.depth
+	if ok {
+		mt = mt.Clone()
+	}
+	e.mu.Unlock()
+	if !ok {
+		mt = e.CreateMerkleTree(hashRange, depth)
+	}
+	return mt
+}
+
+// loadMerkleTree returns the tree of hr persisted in snap, or nil if there is
+// none of the given depth
+func loadMerkleTree(snap StorageSnapshot, hr HashRange, depth int) *MerkleTree {
+	val, err := snap.Get(merkleDepthKey(hr))
+	if err != nil || string(val) != strconv.Itoa(depth) {
+		return nil
+	}
+	mt := CreateMerkleTree(hr, depth)
+	for idx, leaf := range mt.LeafNodes {
+		val, err := snap.Get(merkleLeafKey(hr, idx))
+		if err != nil || val == nil {
+			return nil
+		}
+		leaf.Hash = string(val)
+	}
+	mt.ComputeHashes()
+	return mt
+}
+
+func (e *Engine) saveMerkleTree(hr HashRange, mt *MerkleTree) error {
+	ops := make([]BatchOp, 0, len(mt.LeafNodes)+1)
+	for idx, leaf := range mt.LeafNodes {
+		ops = append(ops, BatchOp{Key: merkleLeafKey(hr, idx), Value: []byte(leaf.Hash)})
+	}
+	ops = append(ops, BatchOp{Key: merkleDepthKey(hr), Value: []byte(strconv.Itoa(mt.Depth))})
+	return e.db.Batch(ops)
+}
+
+// dropUntrackedMerkleTrees deletes persisted trees of ranges no longer
+// tracked, they would be stale by the time the range is tracked again
+func (e *Engine) dropUntrackedMerkleTrees() error {
+	tracked := make(map[string]bool, len(e.trees))
+	for hr := range e.trees {
+		tracked[merkleRangeID(hr)] = true
+	}
+	var stale []BatchOp
+	prefix := []byte(merkleKeyPrefix)
+	err := e.db.Iterate(PrefixRange(prefix, true), func(key, _ []byte) error {
+		rangeID := strings.SplitN(string(key[len(prefix):]), "/", 2)[0]
+		if !tracked[rangeID] {
+			stale = append(stale, BatchOp{Key: key, Delete: true})
+		}
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return e.writeBatches(stale)
 }
 
-func (e *Engine) Stream(f func (key string, value string) error) {
-	e.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := string(item.Key())
-			var value string
-			err := item.Value(func(val []byte) error {
-				value = string(val)
-				return nil
-			})
-			if err != nil {
-				panic(err)
-			}
-			err = f(key, value)
-			if err != nil {
-				return err
-			}
+// writeBatches applies ops in batches of MaxBatchOps, for changes too large
+// to apply atomically
+func (e *Engine) writeBatches(ops []BatchOp) error {
+	for len(ops) > 0 {
+		size := len(ops)
+		if size > MaxBatchOps {
+			size = MaxBatchOps
+		}
+		err := e.db.Batch(ops[:size])
+		if err != nil {
+			return err
+		}
+		ops = ops[size:]
+	}
+	return nil
+}
+
+// StreamLeaves calls f for every key that falls in one of the given leaves of
+// mt, stopping at the first error
+func (e *Engine) StreamLeaves(mt *MerkleTree, leaves []int, f func(key string, rec *Record) error) error {
+	inLeaves := make(map[int]bool, len(leaves))
+	for _, leaf := range leaves {
+		inLeaves[leaf] = true
+	}
+	return e.Stream(func(key string, rec *Record) error {
+		if inLeaves[GetMTLeafIndex(GenerateHash(key), mt.Root)] {
+			return f(key, rec)
 		}
 		return nil
 	})
 }
 
-func (e *Engine) CreateMerkleTree(hashRange HashRange) {
-	e.mt = CreateMerkleTree(hashRange)
-	kvHashLists := make([][]string, len(e.mt.LeafNodes))
-	// iterate over all keys in the range and add them to the merkle tree
-	e.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := string(item.Key())
-			keyHash := GenerateHash(key)
-			idx := GetMTLeafIndex(keyHash, e.mt.Root)
-			if idx == -1 {
-				continue
-			}
-			var value string
-			err := item.Value(func(val []byte) error {
-				value = string(val)
-				return nil
-			})
-			if err != nil {
-				panic(err)
-			}
-			kvHash := GenerateHash(key + value)
-			kvHashLists[idx] = append(kvHashLists[idx], kvHash)
+// StreamRange calls f with every stored key hashing into hr, including its upper bound
+func (e *Engine) StreamRange(hr HashRange, f func(key string, rec *Record) error) error {
+	return e.Stream(func(key string, rec *Record) error {
+		hash := GenerateHash(key)
+		if hash == hr.High || CheckIfHashInHashRange(hash, hr) {
+			return f(key, rec)
 		}
 		return nil
 	})
-	for i, kvHashList := range kvHashLists {
-		sort.Strings(kvHashList)
-		e.mt.LeafNodes[i].Hash = GenerateHashOfList(kvHashList)
-	}
+}
+
+func kvHash(key string, value []byte) string {
+	return GenerateHash(key + string(value))
+}
+
+// Keys starting with InternalKeyPrefix hold engine metadata, not user data
+func IsInternalKey(key string) bool {
+	return strings.HasPrefix(key, InternalKeyPrefix)
+}
+
+func merkleRangeID(hr HashRange) string {
+	return hex.EncodeToString([]byte(hr.Low)) + "-" + hex.EncodeToString([]byte(hr.High))
+}
+
+func merkleLeafKey(hr HashRange, idx int) []byte {
+	return []byte(merkleKeyPrefix + merkleRangeID(hr) + "/" + strconv.Itoa(idx))
+}
+
+func merkleDepthKey(hr HashRange) []byte {
+	return []byte(merkleKeyPrefix + merkleRangeID(hr) + "/depth")
 }
 
 const (
+	MaxBatchOps = 1000
+
+	InternalKeyPrefix = "\x00"
+	merkleKeyPrefix   = InternalKeyPrefix + "mt/"
+
+	// Deleted values were stored as this marker before tombstones became part
+	// of the record; it is only used when migrating legacy values
 	DeletedHash = "hefiwhe783d7qdiq83"
 )
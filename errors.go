@@ -1,8 +1,30 @@
 package main
 
 const (
-	CLUSTER_NOT_STABLE = "cluster is not stable"
-	KEY_NOT_FOUND      = "key not found"
-	READ_TIMEOUT       = "read timeout"
-	WRITE_TIMEOUT      = "write timeout"
+	CLUSTER_NOT_STABLE         = "cluster is not stable"
+	CONTEXT_AHEAD              = "causal context is ahead of the node's clock"
+	CORRUPT_RECORD             = "record checksum mismatch"
+	HANDOFF_FAILED             = "could not hand off every range"
+	HINT_LIMIT_REACHED         = "hint limit reached"
+	INVALID_CONTEXT            = "invalid causal context"
+	INVALID_KEY                = "key must not start with the internal key prefix"
+	INVALID_RECORD             = "invalid record"
+	INVALID_TIMESTAMP          = "invalid timestamp"
+	KEY_NOT_FOUND              = "key not found"
+	NODE_BOOTSTRAPPING         = "node is still bootstrapping"
+	NODE_NOT_DEAD              = "replaced node is still alive"
+	NODE_NOT_FOUND             = "node not found"
+	NODE_NOT_NORMAL            = "node is joining or leaving"
+	NODE_UNREACHABLE           = "node unreachable"
+	NODE_STOPPED               = "node is shutting down"
+	NOT_ENOUGH_NODES           = "not enough nodes for the replication factor"
+	NOT_ENOUGH_REPLICAS        = "not enough replicas alive for the consistency level"
+	READ_TIMEOUT               = "read timeout"
+	REPAIR_RUNNING             = "a repair is already running"
+	REPAIR_STOPPED             = "repair scheduler stopped"
+	REPAIR_TIMEOUT             = "repair timeout"
+	STREAM_TIMEOUT             = "stream timeout"
+	UNSUPPORTED_RECORD_VERSION = "unsupported record version"
+	WEIGHT_CHANGING            = "node is changing its weight"
+	WRITE_TIMEOUT              = "write timeout"
 )
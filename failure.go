@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// PhiDetector is a phi accrual failure detector fed by the round trip times
+// of replica requests. The phi of a peer grows with the time its oldest
+// unanswered request has been waiting, relative to the distribution of its
+// past round trips. A phi of 1 means a 10% chance that the request is just
+// slow, 2 means 1%, 3 means 0.1% and so on.
+type PhiDetector struct {
+	peers map[string]*peerLatency // by padded node name
+	mu    sync.Mutex
+}
+
+// peerLatency holds the recent round trips to a peer and its unanswered requests
+type peerLatency struct {
+	samples []float64 // round trips in milliseconds, used as a ring buffer
+	next    int
+	pending map[string]time.Time // send time by request ID
+}
+
+// PeerPhi is the state of the failure detector for one peer
+type PeerPhi struct {
+	Phi     float64 `json:"phi"`
+	MeanRTT float64 `json:"mean_rtt_ms"`
+	StdDev  float64 `json:"std_dev_ms"`
+	Samples int     `json:"samples"`
+	Pending int     `json:"pending"`
+}
+
+func NewPhiDetector() *PhiDetector {
+	return &PhiDetector{peers: make(map[string]*peerLatency)}
+}
+
+func (d *PhiDetector) peer(name string) *peerLatency {
+	p, ok := d.peers[PadName(name)]
+	if !ok {
+		p = &peerLatency{pending: make(map[string]time.Time)}
+		d.peers[PadName(name)] = p
+	}
+	return p
+}
+
+// Sent records that request reqID was sent to peer
+func (d *PhiDetector) Sent(peer string, reqID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.peer(peer).pending[reqID] = time.Now()
+}
+
+// Received records the answer of peer to request reqID
+func (d *PhiDetector) Received(peer string, reqID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.peer(peer)
+	sent, ok := p.pending[reqID]
+	if !ok {
+		return
+	}
+	delete(p.pending, reqID)
+	rtt := float64(time.Since(sent)) / float64(time.Millisecond)
+	if len(p.samples) < PhiWindowSize {
+		p.samples = append(p.samples, rtt)
+	} else {
+		p.samples[p.next] = rtt
+		p.next = (p.next + 1) % PhiWindowSize
+	}
+}
+
+// Phi returns the current suspicion level of peer, 0 if nothing is known
+func (d *PhiDetector) Phi(peer string) float64 {
+	return d.Stats(peer).Phi
+}
+
+func (d *PhiDetector) Stats(peer string) PeerPhi {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.peer(peer)
+	now := time.Now()
+	var oldest time.Time
+	for reqID, sent := range p.pending {
+		// Requests never answered stop counting eventually, so the peer is tried again
+		if now.Sub(sent) > PhiMaxPending {
+			delete(p.pending, reqID)
+			continue
+		}
+		if oldest.IsZero() || sent.Before(oldest) {
+			oldest = sent
+		}
+	}
+	stats := PeerPhi{Samples: len(p.samples), Pending: len(p.pending)}
+	if len(p.samples) == 0 {
+		return stats
+	}
+	for _, s := range p.samples {
+		stats.MeanRTT += s
+	}
+	stats.MeanRTT /= float64(len(p.samples))
+	for _, s := range p.samples {
+		stats.StdDev += (s - stats.MeanRTT) * (s - stats.MeanRTT)
+	}
+	stats.StdDev = math.Sqrt(stats.StdDev / float64(len(p.samples)))
+	if len(p.samples) >= PhiMinSamples && !oldest.IsZero() {
+		elapsed := float64(now.Sub(oldest)) / float64(time.Millisecond)
+		stats.Phi = phi(elapsed, stats.MeanRTT, math.Max(stats.StdDev, PhiMinStdDev))
+	}
+	return stats
+}
+
+// phi returns -log10 of the probability that a round trip takes longer than
+// elapsed, using the logistic approximation of the normal distribution
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	x := y * (1.5976 + 0.070566*y*y)
+	e := math.Exp(-x)
+	if elapsed > mean {
+		// -log10(e/(1+e)) without e underflowing to 0 for long waits
+		return math.Log10(1+e) + x/math.Ln10
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// selectReplicas returns the replicas a request should be sent to. Dead
+// replicas are always skipped, replicas whose phi exceeds the threshold
+// unless the quorum cannot be reached without them.
+func (n *Node) selectReplicas(replicas []*NodeInfo, quorum *Quorum) []*NodeInfo {
+	alive := n.withoutDead(replicas)
+	if n.Config.PhiThreshold <= 0 {
+		return alive
+	}
+	healthy := make([]*NodeInfo, 0, len(alive))
+	for _, node := range alive {
+		if n.Failures.Phi(node.Name) <= n.Config.PhiThreshold {
+			healthy = append(healthy, node)
+		}
+	}
+	if !quorum.Possible(healthy) {
+		return alive
+	}
+	return healthy
+}
+
+const (
+	DefaultPhiThreshold = 8.0
+	PhiWindowSize       = 100
+	PhiMinSamples       = 3
+	PhiMinStdDev        = 50.0 // milliseconds, keeps fast and steady peers from being suspected on a hiccup
+	PhiMaxPending       = 10 * time.Second
+)
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tombstones are kept for the grace period so deletes reach every replica
+// before they are forgotten. A tombstone past it is purged only once this
+// node repaired its range with every other replica after the delete, so no
+// replica can still hold the deleted value and bring it back through repair.
+
+// CollectTombstones purges the tombstones past the grace period that were
+// exchanged with every other replica of their range. It runs periodically
+// and stops early when the node shuts down.
+func (n *Node) CollectTombstones() {
+	if n.Config.TombstoneGrace <= 0 {
+		return
+	}
+	peers := n.GetRepairPeers()
+	ranges := n.Router.GetHashRangesForNode(n.Info.Name)
+	horizons := make(map[HashRange]int64, len(ranges))
+	for _, hr := range ranges {
+		horizons[hr] = n.tombstoneHorizon(hr, peers[hr])
+	}
+
+	purged := 0
+	err := n.Engine.Stream(func(key string, rec *Record) error {
+		select {
+		case <-n.stop:
+			return errors.New(NODE_STOPPED)
+		default:
+		}
+		hash := GenerateHash(key)
+		for _, hr := range ranges {
+			if hash != hr.High && !CheckIfHashInHashRange(hash, hr) {
+				continue
+			}
+			horizon := horizons[hr]
+			if !rec.Purgeable(horizon) {
+				return nil
+			}
+			// The key may have been written since the snapshot
+			ok, err := n.Engine.PurgeIf(key, func(cur *Record) bool {
+				return cur.Purgeable(horizon)
+			})
+			if ok {
+				purged++
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Tombstone collection stopped: %s", err)
+	}
+	if purged > 0 {
+		log.Infof("Purged %d tombstones", purged)
+	}
+}
+
+// tombstoneHorizon returns the wall time in milliseconds before which
+// tombstones of hr are past the grace period and were exchanged with every
+// peer. Such tombstones can be purged and need not be repaired.
+func (n *Node) tombstoneHorizon(hr HashRange, peers []string) int64 {
+	if n.Config.TombstoneGrace <= 0 {
+		return 0
+	}
+	horizon := physicalTime() - n.Config.TombstoneGrace.Milliseconds()
+	repaired := n.Repairs.LastRepairs(hr)
+	for _, peer := range peers {
+		t, ok := repaired[peer]
+		if !ok {
+			return 0
+		}
+		if ms := t.UnixNano() / int64(time.Millisecond); ms < horizon {
+			horizon = ms
+		}
+	}
+	return horizon
+}
+
+const (
+	DefaultTombstoneGrace = 24 * time.Hour
+	TombstoneGCInterval   = 10 * time.Minute
+)
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The config is disseminated in two ways. Every change is announced by
+// gossiping its version, nodes seeing a newer version fetch the config from
+// the announcer. Push/pull syncs of the membership exchange the full config
+// periodically and on join, so nodes missing an announcement still converge.
+
+// InstallConfig installs a config received from another node if it is newer
+// than the current one, and starts moving data if this node is joining or leaving
+func (n *Node) InstallConfig(cfg *Config) bool {
+	n.cfgMu.Lock()
+	if n.Config != nil && !cfg.Version().Newer(n.Config.Version()) {
+		n.cfgMu.Unlock()
+		return false
+	}
+	log.Infof("Installing config of epoch %d", cfg.Epoch)
+	n.SetConfig(cfg)
+	changes := n.changes
+	n.changes = nil
+	n.cfgMu.Unlock()
+	n.AnnounceConfig()
+	n.onConfigChange()
+	n.recheckChanges(cfg, changes)
+	return true
+}
+
+// UpdateConfig applies change to a copy of the config, installs it under the
+// next epoch and announces it to every other node. Another node changing the
+// config under the same epoch may win over this change, so it is checked
+// again once the next config is installed. Changes must therefore only act
+// on the state they expect, as they may be applied to a later config.
+func (n *Node) UpdateConfig(change func(cfg *Config) error) error {
+	n.cfgMu.Lock()
+	cfg := n.Config.Copy()
+	err := change(cfg)
+	if err != nil {
+		n.cfgMu.Unlock()
+		return err
+	}
+	cfg.AssignTokens()
+	cfg.Epoch++
+	log.Infof("Updating config to epoch %d", cfg.Epoch)
+	n.SetConfig(cfg)
+	n.changes = append(n.changes, change)
+	n.cfgMu.Unlock()
+	n.AnnounceConfig()
+	n.onConfigChange()
+	return nil
+}
+
+// recheckChanges applies the changes made by this node again if cfg, the
+// config installed after them, lost them. A change that fails on cfg no
+// longer applies and is dropped.
+func (n *Node) recheckChanges(cfg *Config, changes []func(cfg *Config) error) {
+	for _, change := range changes {
+		check := cfg.Copy()
+		if change(check) != nil || check.Version() == cfg.Version() {
+			continue
+		}
+		log.Warnf("Config change was lost to a concurrent one, applying it again")
+		err := n.UpdateConfig(change)
+		if err != nil {
+			log.Warnf("Could not apply config change again: %s", err)
+		}
+	}
+}
+
+// AnnounceConfig gossips the version of the current config
+func (n *Node) AnnounceConfig() {
+	var b []byte
+	b = append(b, CONFIG_VERSION)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	msg, err := json.Marshal(n.Config.Version())
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, msg...)
+	n.MList.Broadcast("config", b)
+}
+
+func (n *Node) processConfigVersion(sender string, msg []byte) {
+	var version ConfigVersion
+	err := json.Unmarshal(msg, &version)
+	if err != nil {
+		panic(err)
+	}
+	if n.Config == nil || version.Newer(n.Config.Version()) {
+		n.RequestConfig(sender)
+	}
+}
+
+// configState is the state pushed to other members during push/pull syncs
+func (n *Node) configState() []byte {
+	n.cfgMu.Lock()
+	defer n.cfgMu.Unlock()
+	if n.Config == nil {
+		return nil
+	}
+	return n.Config.SerializeConfig()
+}
+
+func (n *Node) mergeConfigState(b []byte) {
+	n.InstallConfig(DeserializeConfig(b))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/sha256"
+	"math/big"
 	"strconv"
 
 	"github.com/holiman/uint256"
@@ -14,14 +15,18 @@ func GenerateHash(s string) string {
 	return string(h.Sum(nil))
 }
 
-func GenerateHashOfList(lst []string) string {
-	h := sha256.New()
-	for _, s := range lst {
-		h.Write([]byte(s))
+// XorHashes combines two SHA256 hashes so that XorHashes(XorHashes(a, b), b) == a
+func XorHashes(a string, b string) string {
+	x := make([]byte, sha256.Size)
+	for i := 0; i < sha256.Size; i++ {
+		x[i] = a[i] ^ b[i]
 	}
-	return string(h.Sum(nil))
+	return string(x)
 }
 
+// Hash of a Merkle tree leaf without keys
+var EmptyHash = string(make([]byte, sha256.Size))
+
 func CheckIfHashInHashRange(hash string, hr HashRange) bool {
 	if hr.Low < hr.High {
 		if hash > hr.Low && hash < hr.High {
@@ -59,9 +64,24 @@ func GetMidofHashes(hashLow string, hashHigh string) string {
 		}
 	}
 
-	return string(mid.Bytes())
+	b := mid.Bytes32()
+	return string(b[:])
 }
 
+// RangeFraction returns the fraction of the hash space covered by a range
+func RangeFraction(hr HashRange) float64 {
+	var l, h, size uint256.Int
+	l.SetBytes([]byte(hr.Low))
+	h.SetBytes([]byte(hr.High))
+	// wraps around the end of the hash space when High < Low
+	size.Sub(&h, &l)
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(size.ToBig()), shaSpace).Float64()
+	return f
+}
+
+// 2^256, the size of the hash space
+var shaSpace = new(big.Float).SetMantExp(big.NewFloat(1), 256)
+
 func GetSHAMax() uint256.Int {
 	var max uint256.Int
 	b := make([]byte, 32)
@@ -19,3 +19,21 @@ func (h *HashTable) Set(key, value string) {
 func (h *HashTable) Delete(key string) {
 	delete(h.m, key)
 }
+
+// Lookup returns the value of key and whether it is set
+func (h *HashTable) Lookup(key string) (string, bool) {
+	value, ok := h.m[key]
+	return value, ok
+}
+
+func (h *HashTable) Len() int {
+	return len(h.m)
+}
+
+func (h *HashTable) Copy() *HashTable {
+	c := NewHashTable()
+	for k, v := range h.m {
+		c.m[k] = v
+	}
+	return c
+}
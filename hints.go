@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hint is a write that could not be delivered to one of its replicas. It is
+// kept by the coordinator and replayed once the target is reachable again.
+type Hint struct {
+	Target    string    `json:"target"`
+	Key       string    `json:"key"`
+	Record    []byte    `json:"record"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (h *Hint) Expired(ttl time.Duration) bool {
+	return time.Since(h.CreatedAt) > ttl
+}
+
+// Hints are stored under hintKeyPrefix/<target>/<timestamp>/<key> so the
+// hints of a target are replayed in write order
+func hintPrefix(target string) []byte {
+	return []byte(hintKeyPrefix + target + "/")
+}
+
+// StoreHint durably stores a hint unless the target already has limit hints
+func (e *Engine) StoreHint(h *Hint, ts Timestamp, limit int) error {
+	e.hintsMu.Lock()
+	defer e.hintsMu.Unlock()
+	key := append(hintPrefix(h.Target), []byte(ts.Encode()+"/"+h.Key)...)
+	// The same write may be hinted again, it replaces the stored hint
+	old, err := e.db.Get(key)
+	if err != nil {
+		return err
+	}
+	if old == nil && e.hints[h.Target] >= limit {
+		return errors.New(HINT_LIMIT_REACHED)
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	err = e.db.Put(key, b)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		e.hints[h.Target]++
+	}
+	return nil
+}
+
+func (e *Engine) CountHints(target string) int {
+	e.hintsMu.Lock()
+	defer e.hintsMu.Unlock()
+	return e.hints[target]
+}
+
+// countHints counts the stored hints of every target, it is only used to
+// seed the counts kept in memory when the engine is created
+func (e *Engine) countHints() map[string]int {
+	counts := make(map[string]int)
+	e.db.Iterate(PrefixRange([]byte(hintKeyPrefix), true), func(key, _ []byte) error {
+		counts[hintTarget(key)]++
+		return nil
+	})
+	return counts
+}
+
+// StreamHints calls f with the storage key and contents of every hint for target
+func (e *Engine) StreamHints(target string, f func(hintKey []byte, h *Hint) error) error {
+	return e.db.Iterate(PrefixRange(hintPrefix(target), false), func(key, val []byte) error {
+		var h Hint
+		err := json.Unmarshal(val, &h)
+		if err != nil {
+			return err
+		}
+		return f(key, &h)
+	})
+}
+
+// HintTargets returns every node that has hints waiting
+func (e *Engine) HintTargets() []string {
+	var targets []string
+	prefix := []byte(hintKeyPrefix)
+	e.db.Iterate(PrefixRange(prefix, true), func(key, _ []byte) error {
+		target := hintTarget(key)
+		if len(targets) == 0 || targets[len(targets)-1] != target {
+			targets = append(targets, target)
+		}
+		return nil
+	})
+	return targets
+}
+
+func (e *Engine) DeleteHint(hintKey []byte) error {
+	e.hintsMu.Lock()
+	defer e.hintsMu.Unlock()
+	old, err := e.db.Get(hintKey)
+	if err != nil || old == nil {
+		return err
+	}
+	err = e.db.Delete(hintKey)
+	if err != nil {
+		return err
+	}
+	target := hintTarget(hintKey)
+	if e.hints[target]--; e.hints[target] <= 0 {
+		delete(e.hints, target)
+	}
+	return nil
+}
+
+// hintTarget returns the target of the hint stored under hintKey
+func hintTarget(hintKey []byte) string {
+	return strings.SplitN(string(hintKey[len(hintKeyPrefix):]), "/", 2)[0]
+}
+
+// StoreHint keeps a write for a replica that could not be reached
+func (n *Node) StoreHint(target string, key string, rec *Record) error {
+	h := &Hint{Target: target, Key: key, Record: EncodeRecord(rec), CreatedAt: time.Now()}
+	err := n.Engine.StoreHint(h, rec.Timestamp, n.Config.MaxHintsPerNode)
+	if err != nil {
+		log.Warnf("Dropping hint of key=%s for %s: %s", key, target, err)
+		return err
+	}
+	log.Infof("Stored hint of key=%s for %s", key, target)
+	return nil
+}
+
+// replayAllHints replays the hints of every target and drops expired ones.
+// It runs periodically in case a join notification was missed.
+func (n *Node) replayAllHints() {
+	for _, target := range n.Engine.HintTargets() {
+		n.ReplayHints(target)
+	}
+}
+
+// ReplayHints sends every stored hint to its target, deleting each hint once
+// the target acknowledged it. Replay stops at the first unacknowledged hint.
+func (n *Node) ReplayHints(target string) {
+	n.mu.Lock()
+	if n.replaying[target] {
+		n.mu.Unlock()
+		return
+	}
+	n.replaying[target] = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.replaying, target)
+		n.mu.Unlock()
+	}()
+
+	replayed, expired := 0, 0
+	err := n.Engine.StreamHints(target, func(hintKey []byte, h *Hint) error {
+		if h.Expired(n.Config.HintTTL) {
+			expired++
+			return n.Engine.DeleteHint(hintKey)
+		}
+		rec, err := DecodeRecord(h.Record)
+		if err != nil {
+			return err
+		}
+		err = n.RepairKey(h.Key, rec, target)
+		if err != nil {
+			return err
+		}
+		replayed++
+		return n.Engine.DeleteHint(hintKey)
+	})
+	if replayed > 0 || expired > 0 {
+		log.Infof("Replayed %d hints to %s, dropped %d expired", replayed, target, expired)
+	}
+	if err != nil && err.Error() != NODE_UNREACHABLE {
+		log.Warnf("Stopped replaying hints to %s: %s", target, err)
+	}
+}
+
+const (
+	hintKeyPrefix = InternalKeyPrefix + "hint/"
+
+	DefaultHintTTL         = 3 * time.Hour
+	DefaultMaxHintsPerNode = 100000
+	HintReplayInterval     = 1 * time.Minute
+)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHintCounts(t *testing.T) {
+	db := NewMemoryStorage()
+	e := CreateEngine(db)
+	ts := Timestamp{WallTime: 1, NodeID: PadName("n7001")}
+	hint := func(key string) *Hint {
+		return &Hint{Target: "n7002", Key: key, CreatedAt: time.Now()}
+	}
+
+	for _, key := range []string{"a", "b", "a"} {
+		if err := e.StoreHint(hint(key), ts, 2); err != nil {
+			t.Fatalf("storing hint of %s failed: %s", key, err)
+		}
+	}
+	if count := e.CountHints("n7002"); count != 2 {
+		t.Fatalf("counted %d hints, want 2", count)
+	}
+	if err := e.StoreHint(hint("c"), ts, 2); err == nil || err.Error() != HINT_LIMIT_REACHED {
+		t.Fatalf("storing a hint over the limit returned %v, want %s", err, HINT_LIMIT_REACHED)
+	}
+
+	// Counts are seeded from storage when the engine is created
+	if count := CreateEngine(db).CountHints("n7002"); count != 2 {
+		t.Fatalf("counted %d hints after reopening, want 2", count)
+	}
+
+	var keys [][]byte
+	e.StreamHints("n7002", func(hintKey []byte, h *Hint) error {
+		keys = append(keys, hintKey)
+		return nil
+	})
+	for _, key := range append(keys, keys[0]) {
+		if err := e.DeleteHint(key); err != nil {
+			t.Fatalf("deleting hint failed: %s", err)
+		}
+	}
+	if count := e.CountHints("n7002"); count != 0 {
+		t.Fatalf("counted %d hints after deleting them, want 0", count)
+	}
+}
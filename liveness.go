@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Liveness is what the failure detector currently believes about a node
+type Liveness string
+
+const (
+	ALIVE   Liveness = "ALIVE"   // Answering probes
+	SUSPECT Liveness = "SUSPECT" // Missed probes, may still answer requests
+	DEAD    Liveness = "DEAD"    // Declared dead or left the cluster
+)
+
+// NodeLiveness is the liveness of a node and when it last changed
+type NodeLiveness struct {
+	State Liveness  `json:"state"`
+	Since time.Time `json:"since"`
+}
+
+// LivenessView tracks the liveness of every node seen by the membership. Nodes
+// that were never seen count as alive so requests are still attempted.
+type LivenessView struct {
+	nodes map[string]*NodeLiveness
+	mu    sync.RWMutex
+}
+
+func NewLivenessView() *LivenessView {
+	return &LivenessView{nodes: make(map[string]*NodeLiveness)}
+}
+
+// Set records the liveness of a node and returns the previous one, which is
+// empty if the node was never seen
+func (lv *LivenessView) Set(name string, state Liveness) Liveness {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	prev, ok := lv.nodes[name]
+	if ok && prev.State == state {
+		return state
+	}
+	lv.nodes[name] = &NodeLiveness{State: state, Since: time.Now()}
+	if !ok {
+		return ""
+	}
+	return prev.State
+}
+
+func (lv *LivenessView) Get(node *NodeInfo) Liveness {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+	if l, ok := lv.nodes[node.Name]; ok {
+		return l.State
+	}
+	return ALIVE
+}
+
+func (lv *LivenessView) IsDead(node *NodeInfo) bool {
+	return lv.Get(node) == DEAD
+}
+
+// Snapshot returns the liveness of every node seen so far
+func (lv *LivenessView) Snapshot() map[string]NodeLiveness {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+	snapshot := make(map[string]NodeLiveness, len(lv.nodes))
+	for name, l := range lv.nodes {
+		snapshot[name] = *l
+	}
+	return snapshot
+}
+
+// withoutDead returns the nodes not known to be dead
+func (n *Node) withoutDead(nodes []*NodeInfo) []*NodeInfo {
+	alive := make([]*NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if !n.Liveness.IsDead(node) {
+			alive = append(alive, node)
+		}
+	}
+	return alive
+}
+
+func (n *Node) onNodeJoin(name string) {
+	if name == n.Info.Name {
+		return
+	}
+	prev := n.Liveness.Set(name, ALIVE)
+	if n.Config == nil || prev == ALIVE || prev == SUSPECT {
+		return
+	}
+	if prev == DEAD {
+		log.Infof("%s is back, recovering the writes it missed", name)
+		if n.Repairs != nil {
+			n.Repairs.RepairNow(name)
+		}
+	}
+	go n.ReplayHints(name)
+}
+
+func (n *Node) onNodeLeave(name string) {
+	if name == n.Info.Name {
+		return
+	}
+	log.Warnf("%s is dead", name)
+	n.Liveness.Set(name, DEAD)
+}
+
+// checkSuspicions picks up suspicions, which the membership does not report as events
+func (n *Node) checkSuspicions() {
+	for _, member := range n.MList.Members() {
+		if member.Name == n.Info.Name {
+			continue
+		}
+		switch member.State {
+		case SUSPECT:
+			if n.Liveness.Set(member.Name, SUSPECT) == ALIVE {
+				log.Warnf("%s is suspected to have failed", member.Name)
+			}
+		case ALIVE:
+			if n.Liveness.Set(member.Name, ALIVE) == SUSPECT {
+				log.Infof("%s is no longer suspected", member.Name)
+			}
+		}
+	}
+}
+
+const (
+	LivenessCheckInterval = 1 * time.Second
+)
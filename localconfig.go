@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalConfig is configuration of this node only, unlike Config it is not
+// shared with the cluster. It is read from a JSON file and CLI flags.
+type LocalConfig struct {
+	Membership MembershipKind `json:"membership"` // must be the same on every node
+	Storage    StorageKind    `json:"storage"`
+	DataDir    string         `json:"data_dir"` // every node stores its data in a subdirectory named after it
+	Badger     BadgerOptions  `json:"badger"`
+}
+
+// BadgerOptions are the tunable options of the badger storage, sizes are in MB
+type BadgerOptions struct {
+	SyncWrites       bool   `json:"sync_writes"` // fsync every write, slower but survives power loss
+	ValueLogFileSize int64  `json:"value_log_file_size_mb"`
+	BlockCacheSize   int64  `json:"block_cache_size_mb"`
+	Compression      string `json:"compression"` // NONE, SNAPPY or ZSTD
+	MemTableSize     int64  `json:"memtable_size_mb"`
+	InMemory         bool   `json:"in_memory"` // keep everything in memory, nothing is written to the data directory
+}
+
+// DefaultLocalConfig returns the defaults, which match badger's
+func DefaultLocalConfig() *LocalConfig {
+	return &LocalConfig{
+		Membership: MEMBERLIST,
+		Storage:    BADGER,
+		DataDir:    DefaultDataDir,
+		Badger: BadgerOptions{
+			ValueLogFileSize: 1023,
+			BlockCacheSize:   256,
+			Compression:      "SNAPPY",
+			MemTableSize:     64,
+		},
+	}
+}
+
+// LoadLocalConfig reads the config file at path over the defaults
+func LoadLocalConfig(path string) (*LocalConfig, error) {
+	lc := DefaultLocalConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, lc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	return lc, nil
+}
+
+func (lc *LocalConfig) Validate() error {
+	if lc.Membership != MEMBERLIST && lc.Membership != SWIM {
+		return fmt.Errorf("invalid membership %q, must be MEMBERLIST or SWIM", lc.Membership)
+	}
+	if lc.Storage != BADGER && lc.Storage != MEMORY {
+		return fmt.Errorf("invalid storage %q, must be BADGER or MEMORY", lc.Storage)
+	}
+	if lc.Storage != BADGER {
+		return nil
+	}
+	b := lc.Badger
+	if lc.DataDir == "" && !b.InMemory {
+		return fmt.Errorf("data directory is not set")
+	}
+	// badger maps value log files with 32 bit offsets
+	if b.ValueLogFileSize < 1 || b.ValueLogFileSize >= 2048 {
+		return fmt.Errorf("value log file size must be between 1 and 2047 MB, got %d", b.ValueLogFileSize)
+	}
+	if b.BlockCacheSize < 0 {
+		return fmt.Errorf("block cache size must not be negative, got %d", b.BlockCacheSize)
+	}
+	// badger needs room for a 1 MB value in a batch, which is 15% of the memtable
+	if b.MemTableSize < 8 {
+		return fmt.Errorf("memtable size must be at least 8 MB, got %d", b.MemTableSize)
+	}
+	switch b.Compression {
+	case "NONE", "SNAPPY", "ZSTD":
+	default:
+		return fmt.Errorf("invalid compression %q, must be NONE, SNAPPY or ZSTD", b.Compression)
+	}
+	return nil
+}
+
+// NodeDataDir is the directory the named node stores its data in
+func (lc *LocalConfig) NodeDataDir(name string) string {
+	return filepath.Join(lc.DataDir, name)
+}
+
+// LogSummary logs the settings the node starts with
+func (lc *LocalConfig) LogSummary(name string) {
+	log.Infof("Membership: %s", lc.Membership)
+	if lc.Storage != BADGER {
+		log.Infof("Storage: %s, data is lost when the node stops", lc.Storage)
+		return
+	}
+	b := lc.Badger
+	if b.InMemory {
+		log.Infof("Storage: BADGER in memory, data is lost when the node stops")
+	} else {
+		log.Infof("Storage: BADGER in %s", lc.NodeDataDir(name))
+		if _, err := os.Stat(filepath.Join(legacyDataDir, name)); err == nil && lc.DataDir != legacyDataDir {
+			log.Warnf("Found data of %s in %s, the former default, set the data directory to it to keep using it", name, legacyDataDir)
+		}
+		if dir := filepath.Clean(lc.DataDir); dir == "/tmp" || strings.HasPrefix(dir, "/tmp/") {
+			log.Warnf("Data directory %s may be cleared on reboot", lc.DataDir)
+		}
+	}
+	log.Infof("Badger: sync writes %t, value log files %d MB, block cache %d MB, memtables %d MB, compression %s",
+		b.SyncWrites, b.ValueLogFileSize, b.BlockCacheSize, b.MemTableSize, b.Compression)
+}
+
+const (
+	DefaultDataDir = "data" // relative to the working directory
+
+	legacyDataDir = "/tmp/badger"
+)
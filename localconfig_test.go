@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLocalConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(lc *LocalConfig)
+		valid  bool
+	}{
+		{"defaults", func(lc *LocalConfig) {}, true},
+		{"swim", func(lc *LocalConfig) { lc.Membership = SWIM }, true},
+		{"unknown membership", func(lc *LocalConfig) { lc.Membership = "GOSSIP" }, false},
+		{"unknown storage", func(lc *LocalConfig) { lc.Storage = "ROCKS" }, false},
+		{"memory ignores badger options", func(lc *LocalConfig) { lc.Storage = MEMORY; lc.Badger.MemTableSize = 0 }, true},
+		{"no data directory", func(lc *LocalConfig) { lc.DataDir = "" }, false},
+		{"no data directory in memory", func(lc *LocalConfig) { lc.DataDir = ""; lc.Badger.InMemory = true }, true},
+		{"value log file too small", func(lc *LocalConfig) { lc.Badger.ValueLogFileSize = 0 }, false},
+		{"value log file too large", func(lc *LocalConfig) { lc.Badger.ValueLogFileSize = 2048 }, false},
+		{"largest value log file", func(lc *LocalConfig) { lc.Badger.ValueLogFileSize = 2047 }, true},
+		{"negative block cache", func(lc *LocalConfig) { lc.Badger.BlockCacheSize = -1 }, false},
+		{"no block cache", func(lc *LocalConfig) { lc.Badger.BlockCacheSize = 0 }, true},
+		{"memtable too small", func(lc *LocalConfig) { lc.Badger.MemTableSize = 7 }, false},
+		{"no compression", func(lc *LocalConfig) { lc.Badger.Compression = "NONE" }, true},
+		{"unknown compression", func(lc *LocalConfig) { lc.Badger.Compression = "LZ4" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := DefaultLocalConfig()
+			tt.change(lc)
+			if err := lc.Validate(); (err == nil) != tt.valid {
+				t.Fatalf("validation returned %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
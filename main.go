@@ -1,11 +1,56 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 )
 
 func seed(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	vclockKeyspaces := fs.String("vclock-keyspaces", "", "comma separated keyspaces that keep concurrent writes as siblings")
+	repairInterval := fs.Duration("repair-interval", DefaultRepairInterval, "how often each range is repaired in the background")
+	readRepair := fs.String("read-repair", string(ASYNC_READ_REPAIR), "read repair mode: NONE, ASYNC or SYNC")
+	readRepairWaitAll := fs.Bool("read-repair-wait-all", false, "wait for every replica after quorum to detect divergence")
+	weights := fs.String("weights", "", "comma separated name=weight capacity weights, nodes default to 1")
+	vnodes := fs.Int("vnodes", DefaultVNodes, "number of tokens each node owns on the ring")
+	merkleDepth := fs.Int("merkle-depth", DefaultMerkleDepth, "depth of the merkle trees used for repair, larger ranges need deeper trees")
+	zones := fs.String("zones", "", "comma separated name=zone racks or availability zones of the nodes")
+	placement := fs.String("placement", string(SIMPLE), "replica placement: SIMPLE or ZONE_AWARE")
+	consistency := fs.String("consistency", "QUORUM", "consistency level: QUORUM, ALL or LOCAL_QUORUM")
+	phiThreshold := fs.Float64("phi-threshold", DefaultPhiThreshold, "suspicion level above which replicas are avoided, 0 disables")
+	tombstoneGrace := fs.Duration("tombstone-grace", DefaultTombstoneGrace, "how long deletes are kept before they can be purged, 0 keeps them forever")
+	localConfig := localFlags(fs)
+	fs.Parse(args)
+	args = fs.Args()
+	if *vnodes <= 0 {
+		panic("Number of vnodes must be greater than 0")
+	}
+	consistencyLevel, ok := ParseConsistencyLevel(*consistency)
+	if !ok {
+		panic("Invalid consistency level " + *consistency)
+	}
+	if PlacementStrategy(*placement) != SIMPLE && PlacementStrategy(*placement) != ZONE_AWARE {
+		panic("Invalid placement " + *placement)
+	}
+	switch ReadRepairMode(*readRepair) {
+	case NO_READ_REPAIR, ASYNC_READ_REPAIR, SYNC_READ_REPAIR:
+	default:
+		usageError(fs, "Invalid read repair mode "+*readRepair+", must be NONE, ASYNC or SYNC")
+	}
+	if *merkleDepth < 1 || *merkleDepth > MaxMerkleDepth {
+		usageError(fs, fmt.Sprintf("Merkle depth must be between 1 and %d", MaxMerkleDepth))
+	}
+	local := localConfig()
+
 	var nodes []*NodeInfo
 	for i := 0; i < len(args); i++ {
 		port, err := strconv.Atoi(args[i])
@@ -21,13 +66,133 @@ func seed(args []string) {
 	}
 	cfg := CreateConfig(
 		THREE,
-		QUORUM,
+		consistencyLevel,
 		nodes)
-	n := StartNode(cfg, nodes[0], nil)
+	for _, ks := range strings.Split(*vclockKeyspaces, ",") {
+		if ks != "" {
+			cfg.Keyspaces[ks] = VECTOR_CLOCK
+		}
+	}
+	cfg.VNodes = *vnodes
+	for name, w := range parseNodeValues(*weights) {
+		weight, err := strconv.ParseFloat(w, 64)
+		if err != nil || weight <= 0 {
+			panic("Invalid weight " + name + "=" + w)
+		}
+		for _, node := range nodes {
+			if node.Name == name {
+				node.Weight = weight
+			}
+		}
+	}
+	for name, zone := range parseNodeValues(*zones) {
+		for _, node := range nodes {
+			if node.Name == name {
+				node.Zone = zone
+			}
+		}
+	}
+	cfg.Placement = PlacementStrategy(*placement)
+	cfg.MerkleDepth = *merkleDepth
+	cfg.RepairInterval = *repairInterval
+	cfg.ReadRepair = ReadRepairMode(*readRepair)
+	cfg.ReadRepairWaitAll = *readRepairWaitAll
+	cfg.PhiThreshold = *phiThreshold
+	cfg.TombstoneGrace = *tombstoneGrace
+	n := StartNode(cfg, nodes[0], nil, local)
 	n.Server.Start()
 }
 
+// localFlags registers the flags of the node's LocalConfig. The returned
+// function must be called after parsing, it reads the config file, applies
+// the flags that were set over it and validates the result.
+func localFlags(fs *flag.FlagSet) func() *LocalConfig {
+	defaults := DefaultLocalConfig()
+	configFile := fs.String("config", "", "node config file in JSON, flags override its settings")
+	membership := fs.String("membership", string(defaults.Membership), "membership implementation of the cluster: MEMBERLIST or SWIM")
+	storage := fs.String("storage", string(defaults.Storage), "storage engine: BADGER or MEMORY")
+	dataDir := fs.String("data-dir", defaults.DataDir, "directory the node stores its data in")
+	syncWrites := fs.Bool("sync-writes", defaults.Badger.SyncWrites, "fsync every badger write")
+	vlogSize := fs.Int64("vlog-file-size", defaults.Badger.ValueLogFileSize, "size of badger value log files in MB")
+	blockCache := fs.Int64("block-cache-size", defaults.Badger.BlockCacheSize, "size of the badger block cache in MB")
+	compression := fs.String("compression", defaults.Badger.Compression, "badger block compression: NONE, SNAPPY or ZSTD")
+	memTable := fs.Int64("memtable-size", defaults.Badger.MemTableSize, "size of badger memtables in MB")
+	inMemory := fs.Bool("in-memory", defaults.Badger.InMemory, "run badger in memory without writing to the data directory")
+	return func() *LocalConfig {
+		lc := DefaultLocalConfig()
+		if *configFile != "" {
+			var err error
+			lc, err = LoadLocalConfig(*configFile)
+			if err != nil {
+				panic(err)
+			}
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "membership":
+				lc.Membership = MembershipKind(*membership)
+			case "storage":
+				lc.Storage = StorageKind(*storage)
+			case "data-dir":
+				lc.DataDir = *dataDir
+			case "sync-writes":
+				lc.Badger.SyncWrites = *syncWrites
+			case "vlog-file-size":
+				lc.Badger.ValueLogFileSize = *vlogSize
+			case "block-cache-size":
+				lc.Badger.BlockCacheSize = *blockCache
+			case "compression":
+				lc.Badger.Compression = *compression
+			case "memtable-size":
+				lc.Badger.MemTableSize = *memTable
+			case "in-memory":
+				lc.Badger.InMemory = *inMemory
+			}
+		})
+		err := lc.Validate()
+		if err != nil {
+			panic(err)
+		}
+		return lc
+	}
+}
+
+// usageError prints msg and the flags of fs, then exits
+func usageError(fs *flag.FlagSet, msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	fs.Usage()
+	os.Exit(2)
+}
+
+// parseNodeValues parses a comma separated list of name=value pairs
+func parseNodeValues(s string) map[string]string {
+	values := make(map[string]string)
+	for _, nv := range strings.Split(s, ",") {
+		if nv == "" {
+			continue
+		}
+		parts := strings.SplitN(nv, "=", 2)
+		if len(parts) != 2 {
+			panic("Invalid name=value pair " + nv)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values
+}
+
 func join(args []string) {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	zone := fs.String("zone", "", "rack or availability zone of the node")
+	weight := fs.Float64("weight", 1, "capacity weight of the node, used if it is not in the cluster yet, see the weight command")
+	replace := fs.String("replace", "", "name of a dead node whose ring position this node takes over")
+	localConfig := localFlags(fs)
+	fs.Parse(args)
+	args = fs.Args()
+	if *weight <= 0 {
+		panic("Weight must be greater than 0")
+	}
+	local := localConfig()
+
 	var nodes []*NodeInfo
 	for i := 0; i < len(args); i++ {
 		port, err := strconv.Atoi(args[i])
@@ -41,10 +206,151 @@ func join(args []string) {
 			APIPort: strconv.Itoa(1000 + port),
 		})
 	}
-	n := StartNode(nil, nodes[0], nodes[1])
+	nodes[0].Zone = *zone
+	nodes[0].Weight = *weight
+	nodes[0].Replaces = *replace
+	n := StartNode(nil, nodes[0], nodes[1], local)
 	n.Server.Start()
 }
 
+// ownership prints the keyspace share of every node as reported by the node
+// at args[0], and the projected shares if a node and a new weight are given
+func ownership(args []string) {
+	if len(args) != 1 && len(args) != 3 {
+		fmt.Println("usage: ownership <addr:api_port> [<node> <weight>]")
+		os.Exit(1)
+	}
+	query := url.Values{}
+	if len(args) == 3 {
+		query.Set("node", args[1])
+		query.Set("weight", args[2])
+	}
+	resp, err := http.Get("http://" + args[0] + "/admin/ownership?" + query.Encode())
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println(string(b))
+		os.Exit(1)
+	}
+	var report OwnershipReport
+	err = json.Unmarshal(b, &report)
+	if err != nil {
+		panic(err)
+	}
+
+	names := make([]string, 0, len(report.Current))
+	for name := range report.Current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if report.Projected == nil {
+		fmt.Fprintln(tw, "NODE\tTOKENS\tPRIMARY\tREPLICA")
+		for _, name := range names {
+			o := report.Current[name]
+			fmt.Fprintf(tw, "%s\t%d\t%.2f%%\t%.2f%%\n", name, o.Tokens, o.Primary, o.Replica)
+		}
+	} else {
+		fmt.Fprintln(tw, "NODE\tTOKENS\tPRIMARY\tREPLICA\tNEW TOKENS\tNEW PRIMARY\tNEW REPLICA")
+		for _, name := range names {
+			o, p := report.Current[name], report.Projected[name]
+			fmt.Fprintf(tw, "%s\t%d\t%.2f%%\t%.2f%%\t%d\t%.2f%%\t%.2f%%\n",
+				name, o.Tokens, o.Primary, o.Replica, p.Tokens, p.Primary, p.Replica)
+		}
+	}
+	tw.Flush()
+}
+
+// cluster prints every node of the cluster as reported by the node at args[0]
+func cluster(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: cluster <addr:api_port>")
+		os.Exit(1)
+	}
+	resp, err := http.Get("http://" + args[0] + "/admin/cluster")
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println(string(b))
+		os.Exit(1)
+	}
+	var report ClusterReport
+	err = json.Unmarshal(b, &report)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Config epoch %d\n", report.Epoch)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tSTATUS\tLIVENESS\tZONE\tAPI\tVERSION\tKEYS")
+	for _, node := range report.Nodes {
+		api, version, keys := "?", "?", "?"
+		if node.Meta != nil {
+			api, version, keys = node.Meta.APIAddr, node.Meta.Version, strconv.FormatUint(node.Meta.Keys, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node.Name, node.Status, node.Liveness, node.Zone, api, version, keys)
+	}
+	tw.Flush()
+}
+
+// weight asks the node at args[0] to change the weight of a node, use
+// ownership to see the projected shares first
+func weight(args []string) {
+	if len(args) != 3 {
+		fmt.Println("usage: weight <addr:api_port> <node> <weight>")
+		os.Exit(1)
+	}
+	query := url.Values{}
+	query.Set("node", args[1])
+	query.Set("weight", args[2])
+	resp, err := http.Post("http://"+args[0]+"/admin/weight?"+query.Encode(), "", nil)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+	if resp.StatusCode != http.StatusAccepted {
+		os.Exit(1)
+	}
+}
+
+// decommission asks the node at args[0] to hand off its ranges and leave the cluster
+func decommission(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: decommission <addr:api_port>")
+		os.Exit(1)
+	}
+	resp, err := http.Post("http://"+args[0]+"/admin/decommission", "", nil)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+	if resp.StatusCode != http.StatusAccepted {
+		os.Exit(1)
+	}
+}
+
 func main() {
 	args := os.Args
 	args = args[1:]
@@ -54,5 +360,13 @@ func main() {
 		seed(args[1:])
 	case "join":
 		join(args[1:])
+	case "ownership":
+		ownership(args[1:])
+	case "decommission":
+		decommission(args[1:])
+	case "weight":
+		weight(args[1:])
+	case "cluster":
+		cluster(args[1:])
 	}
 }
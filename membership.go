@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+)
+
+// Membership tracks which nodes are in the cluster and carries messages
+// between them. Messages received are handed to the delegate and membership
+// changes are reported to the events given when it was created.
+type Membership interface {
+	// Join joins the cluster through the seed node, exchanging cluster state with it
+	Join(seedNode *NodeInfo) error
+	// Leave tells the other members this node is leaving and stops
+	Leave() error
+	SendTCP(msg []byte, name string) error
+	SendUDP(msg []byte, name string) error
+	// Broadcast gossips msg to every member. A queued message is dropped when
+	// a newer one with the same name is broadcast.
+	Broadcast(name string, msg []byte)
+	// UpdateNode advertises the local node's metadata again
+	UpdateNode() error
+	// Meta returns the metadata last advertised by every alive member
+	Meta() map[string][]byte
+	// Members returns the known members, including the local node
+	Members() []Member
+	CheckIfNodeAlive(node *NodeInfo) bool
+	// WaitForNode waits until the named node is a known member
+	WaitForNode(name string, timeout time.Duration) bool
+}
+
+// Member is a node as seen by the membership
+type Member struct {
+	Name  string
+	State Liveness
+}
+
+// MembershipKind selects the membership implementation
+type MembershipKind string
+
+const (
+	MEMBERLIST MembershipKind = "MEMBERLIST" // hashicorp memberlist
+	SWIM       MembershipKind = "SWIM"       // the SWIM implementation in swim.go
+)
+
+// CreateMembership starts the membership implementation of the given kind
+func CreateMembership(kind MembershipKind, node *NodeInfo, delegate *MemberListDelegate, events *MemberListEvents) Membership {
+	if kind == SWIM {
+		return CreateSwimList(node, delegate, events)
+	}
+	return CreateMemberList(node, delegate, events)
+}
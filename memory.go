@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStorage is a StorageEngine keeping everything in a HashTable, with a
+// sorted index of its keys for ordered iteration
+type MemoryStorage struct {
+	table *HashTable
+	index []string // sorted keys of table
+	bytes int64
+	mu    sync.RWMutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{table: NewHashTable()}
+}
+
+func (s *MemoryStorage) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return memoryGet(s.table, key), nil
+}
+
+func (s *MemoryStorage) Put(key, value []byte) error {
+	return s.Batch([]BatchOp{{Key: key, Value: value}})
+}
+
+func (s *MemoryStorage) Delete(key []byte) error {
+	return s.Batch([]BatchOp{{Key: key, Delete: true}})
+}
+
+func (s *MemoryStorage) Batch(ops []BatchOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range ops {
+		key := string(op.Key)
+		old, exists := s.table.Lookup(key)
+		if exists {
+			s.bytes -= int64(len(key) + len(old))
+		}
+		i := sort.SearchStrings(s.index, key)
+		if op.Delete {
+			if exists {
+				s.table.Delete(key)
+				s.index = append(s.index[:i], s.index[i+1:]...)
+			}
+			continue
+		}
+		s.table.Set(key, string(op.Value))
+		s.bytes += int64(len(key) + len(op.Value))
+		if !exists {
+			s.index = append(s.index, "")
+			copy(s.index[i+1:], s.index[i:])
+			s.index[i] = key
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Iterate(r KeyRange, f func(key, value []byte) error) error {
+	// Collect first so f may write to the storage
+	s.mu.RLock()
+	keys, values := memoryRange(s.table, s.index, r)
+	s.mu.RUnlock()
+	return memoryCall(keys, values, f)
+}
+
+// Snapshot copies the whole storage, fine for the small data sets it is meant for
+func (s *MemoryStorage) Snapshot() (StorageSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &memorySnapshot{table: s.table.Copy(), index: append([]string{}, s.index...)}, nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) Stats() EngineStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return EngineStats{Keys: uint64(s.table.Len()), LSMBytes: s.bytes}
+}
+
+type memorySnapshot struct {
+	table *HashTable
+	index []string
+}
+
+func (s *memorySnapshot) Get(key []byte) ([]byte, error) {
+	return memoryGet(s.table, key), nil
+}
+
+func (s *memorySnapshot) Iterate(r KeyRange, f func(key, value []byte) error) error {
+	keys, values := memoryRange(s.table, s.index, r)
+	return memoryCall(keys, values, f)
+}
+
+func (s *memorySnapshot) Release() {}
+
+func memoryGet(table *HashTable, key []byte) []byte {
+	value, ok := table.Lookup(string(key))
+	if !ok {
+		return nil
+	}
+	return []byte(value)
+}
+
+// memoryRange returns the keys of index in r and their values
+func memoryRange(table *HashTable, index []string, r KeyRange) (keys [][]byte, values [][]byte) {
+	for i := sort.SearchStrings(index, string(r.Start)); i < len(index); i++ {
+		key := index[i]
+		if r.End != nil && key >= string(r.End) {
+			break
+		}
+		keys = append(keys, []byte(key))
+		if r.KeysOnly {
+			values = append(values, nil)
+		} else {
+			values = append(values, []byte(table.Get(key)))
+		}
+	}
+	return keys, values
+}
+
+func memoryCall(keys [][]byte, values [][]byte, f func(key, value []byte) error) error {
+	for i := range keys {
+		err := f(keys[i], values[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
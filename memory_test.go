@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// keysIn returns the keys iterate passes for r, in order
+func keysIn(t *testing.T, iterate func(r KeyRange, f func(key, value []byte) error) error, r KeyRange) []string {
+	t.Helper()
+	var keys []string
+	err := iterate(r, func(key, value []byte) error {
+		if r.KeysOnly != (value == nil) {
+			t.Fatalf("key %s passed with value %q", key, value)
+		}
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterating failed: %s", err)
+	}
+	return keys
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Put([]byte("b"), []byte("2"))
+	s.Batch([]BatchOp{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("p/2"), Value: []byte("4")},
+		{Key: []byte("p/1"), Value: []byte("3")},
+		{Key: []byte("c"), Value: []byte("x")},
+		{Key: []byte("c"), Delete: true},
+		{Key: []byte("missing"), Delete: true},
+		{Key: []byte("b"), Value: []byte("22")},
+	})
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %s", err)
+	}
+	defer snap.Release()
+	s.Put([]byte("d"), []byte("5"))
+	s.Delete([]byte("a"))
+
+	gets := []struct {
+		key  string
+		want []byte
+	}{
+		{"a", nil},
+		{"b", []byte("22")},
+		{"c", nil},
+		{"d", []byte("5")},
+		{"p/1", []byte("3")},
+	}
+	for _, tt := range gets {
+		if got, _ := s.Get([]byte(tt.key)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("get %s returned %q, want %q", tt.key, got, tt.want)
+		}
+	}
+	if got, _ := snap.Get([]byte("a")); string(got) != "1" {
+		t.Errorf("snapshot get a returned %q, want 1", got)
+	}
+
+	ranges := []struct {
+		name string
+		r    KeyRange
+		want []string
+		snap []string // keys in the snapshot
+	}{
+		{"everything", KeyRange{}, []string{"b", "d", "p/1", "p/2"}, []string{"a", "b", "p/1", "p/2"}},
+		{"bounded", KeyRange{Start: []byte("b"), End: []byte("p/2")}, []string{"b", "d", "p/1"}, []string{"b", "p/1"}},
+		{"prefix", PrefixRange([]byte("p/"), false), []string{"p/1", "p/2"}, []string{"p/1", "p/2"}},
+		{"keys only", PrefixRange([]byte("p/"), true), []string{"p/1", "p/2"}, []string{"p/1", "p/2"}},
+		{"empty", PrefixRange([]byte("x"), false), nil, nil},
+	}
+	for _, tt := range ranges {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keysIn(t, s.Iterate, tt.r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("iterated %v, want %v", got, tt.want)
+			}
+			if got := keysIn(t, snap.Iterate, tt.r); !reflect.DeepEqual(got, tt.snap) {
+				t.Errorf("snapshot iterated %v, want %v", got, tt.snap)
+			}
+		})
+	}
+
+	stats := s.Stats()
+	if stats.Keys != 4 || stats.LSMBytes != int64(len("b22d5p/13p/24")) {
+		t.Errorf("stats are %+v, want 4 keys of %d bytes", stats, len("b22d5p/13p/24"))
+	}
+}
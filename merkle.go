@@ -1,8 +1,12 @@
 package main
 
+// Leaf hashes are the XOR of the hashes of every key and record in the leaf,
+// so a single key can be added or removed without rehashing the whole leaf.
+// Interior hashes are the hash of both children's hashes.
 type MerkleTree struct {
 	Root      *MTNode
 	LeafNodes []*MTNode
+	Depth     int
 }
 
 // Merkle tree node
@@ -16,7 +20,7 @@ type MTNode struct {
 	RngEnd    string // Excludes this
 }
 
-func CreateMerkleTree(hr HashRange) *MerkleTree {
+func CreateMerkleTree(hr HashRange, depth int) *MerkleTree {
 	hashLow := hr.Low
 	hashHigh := hr.High
 	root := &MTNode{
@@ -29,7 +33,8 @@ func CreateMerkleTree(hr HashRange) *MerkleTree {
 		RngEnd:    hashHigh,
 	}
 	mt := &MerkleTree{
-		Root: root,
+		Root:  root,
+		Depth: depth,
 	}
 	mt.GenerateTree()
 	return mt
@@ -39,9 +44,75 @@ func (mt *MerkleTree) GenerateTree() {
 	mt.Root.CreateChildren(mt)
 }
 
+// ComputeHashes fills in interior node hashes from the leaf hashes
+func (mt *MerkleTree) ComputeHashes() {
+	mt.Root.computeHash()
+}
+
+func (mtn *MTNode) computeHash() string {
+	if !mtn.IsLeaf {
+		mtn.Hash = GenerateHash(mtn.Left.computeHash() + mtn.Right.computeHash())
+	}
+	return mtn.Hash
+}
+
+// UpdateLeaf XORs delta into a leaf and rehashes its ancestors
+func (mt *MerkleTree) UpdateLeaf(idx int, delta string) {
+	var ancestors []*MTNode
+	mtn := mt.Root
+	for bit := mt.Depth - 1; bit >= 0; bit-- {
+		ancestors = append(ancestors, mtn)
+		if idx&(1<<bit) == 0 {
+			mtn = mtn.Left
+		} else {
+			mtn = mtn.Right
+		}
+	}
+	mtn.Hash = XorHashes(mtn.Hash, delta)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		ancestors[i].Hash = GenerateHash(ancestors[i].Left.Hash + ancestors[i].Right.Hash)
+	}
+}
+
+// Clone returns a deep copy of the tree
+func (mt *MerkleTree) Clone() *MerkleTree {
+	c := &MerkleTree{Depth: mt.Depth}
+	c.Root = mt.Root.clone(c)
+	return c
+}
+
+func (mtn *MTNode) clone(mt *MerkleTree) *MTNode {
+	c := *mtn
+	if mtn.IsLeaf {
+		mt.LeafNodes = append(mt.LeafNodes, &c)
+	} else {
+		c.Left = mtn.Left.clone(mt)
+		c.Right = mtn.Right.clone(mt)
+	}
+	return &c
+}
+
+// GetNode returns the node at path, a string of 0s (left) and 1s (right)
+// starting from the root. A leaf's path is its index in binary.
+func (mt *MerkleTree) GetNode(path string) *MTNode {
+	node := mt.Root
+	for _, c := range path {
+		if node == nil || node.IsLeaf {
+			return nil
+		}
+		if c == '0' {
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+	return node
+}
+
 func (mtn *MTNode) CreateChildren(mt *MerkleTree) {
-	if mtn.CurrDepth == MaxDepth {
+	if mtn.CurrDepth == mt.Depth {
 		mtn.IsLeaf = true
+		mtn.Hash = EmptyHash
 		mt.LeafNodes = append(mt.LeafNodes, mtn)
 		return
 	}
@@ -69,5 +140,6 @@ func (mtn *MTNode) CreateChildren(mt *MerkleTree) {
 }
 
 const (
-	MaxDepth int = 3
+	DefaultMerkleDepth int = 3
+	MaxMerkleDepth     int = 20 // a tree has 2^depth leaves
 )
@@ -2,105 +2,156 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Every message is framed as type (1 byte), padded sender name (8 bytes) and
+// the sender's hybrid logical clock (TimestampLen bytes), followed by the payload
 func (n *Node) ProcessMsg(b []byte) {
 	mType := uint8(b[0])
 	sender := string(b[1:9])
-	msg := b[9:]
+	ts, err := DecodeTimestamp(string(b[9 : 9+TimestampLen]))
+	if err != nil {
+		log.Warnf("Dropping message from %s with invalid clock", sender)
+		return
+	}
+	n.Clock.Update(ts)
+	msg := b[9+TimestampLen:]
 	if mType == REQUEST_CONFIG {
 		n.processRequestConfig(sender)
 	} else if mType == RESPONSE_CONFIG {
 		n.processResponseConfig(msg)
+	} else if mType == CONFIG_VERSION {
+		n.processConfigVersion(sender, msg)
 	} else if mType == REQUEST_READ {
 		n.processRequestRead(sender, msg)
 	} else if mType == RESPONSE_READ {
-		n.processResponseRead(msg)
+		n.processResponseRead(sender, msg)
 	} else if mType == REQUEST_WRITE {
 		n.processRequestWrite(sender, msg)
 	} else if mType == RESPONSE_WRITE {
-		n.processResponseWrite(msg)
+		n.processResponseWrite(sender, msg)
 	} else if mType == REQUEST_REPAIR {
 		n.processRequestRepair(sender, msg)
+	} else if mType == RESPONSE_REPAIR {
+		n.processResponseRepair(sender, msg)
+	} else if mType == REQUEST_MERKLE {
+		n.processRequestMerkle(sender, msg)
+	} else if mType == RESPONSE_MERKLE {
+		n.processResponseMerkle(sender, msg)
+	} else if mType == REQUEST_MERKLE_SYNC {
+		n.processRequestMerkleSync(sender, msg)
+	} else if mType == REQUEST_JOIN {
+		n.processRequestJoin(sender, msg)
+	} else if mType == REQUEST_JOIN_COMPLETE {
+		n.processRequestJoinComplete(sender, msg)
+	} else if mType == REQUEST_STREAM {
+		n.processRequestStream(sender, msg)
+	} else if mType == RESPONSE_STREAM {
+		n.processResponseStream(sender, msg)
 	} else {
-		log.Infof("Unknown message type %s", mType)
+		log.Infof("Unknown message type %d", mType)
 	}
 }
 
-func (n *Node) RequestConfig(seedNode *NodeInfo) {
+func (n *Node) RequestConfig(to string) {
 	var b []byte
 	b = append(b, REQUEST_CONFIG)
 	b = append(b, []byte(n.Info.GetSenderName())...)
-	log.Infof("Requesting config from %s", seedNode.Name)
-	n.MList.SendTCP(b, seedNode.Name)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	log.Infof("Requesting config from %s", to)
+	n.MList.SendTCP(b, to)
 }
 
 func (n *Node) processRequestConfig(sender string) {
+	if n.Config == nil {
+		return
+	}
+	n.SendConfig(sender)
+}
+
+// SendConfig sends the current config to another node, which installs it if
+// it is newer than its own
+func (n *Node) SendConfig(to string) error {
 	cfg := n.Config.SerializeConfig()
 	var b []byte
 	b = append(b, RESPONSE_CONFIG)
 	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
 	b = append(b, cfg...)
-	log.Infof("Sending config to %s", sender)
-	n.MList.SendTCP(b, sender)
+	log.Infof("Sending config to %s", to)
+	return n.MList.SendTCP(b, to)
 }
 
 func (n *Node) processResponseConfig(msg []byte) {
-	n.Config = DeserializeConfig(msg)
-	n.Router = CreateRouter(n.Config)
+	n.InstallConfig(DeserializeConfig(msg))
 }
 
-func (n *Node) RequestRead(key string, to string) {
+func (n *Node) RequestRead(reqID string, key string, to string) {
 	var b []byte
 	b = append(b, REQUEST_READ)
 	b = append(b, []byte(n.Info.GetSenderName())...)
-	b = append(b, []byte(key)...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(ReadRequestMsg{ReqID: reqID, Key: key})
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, reqMsg...)
 	log.Infof("Requesting read of key=%s from %s", key, to)
 	n.MList.SendTCP(b, to)
 }
 
 func (n *Node) processRequestRead(sender string, msg []byte) {
-	key := string(msg)
-	value, err := n.Engine.Read(key)
+	var reqMsg ReadRequestMsg
+	err := json.Unmarshal(msg, &reqMsg)
+	if err != nil {
+		panic(err)
+	}
+	key := reqMsg.Key
+	rec, err := n.Engine.Read(key)
 	if err != nil {
 		panic(err)
 	}
 	var b []byte
 	b = append(b, RESPONSE_READ)
 	b = append(b, []byte(n.Info.GetSenderName())...)
-	respMsg, err := json.Marshal(ReadRequestMsg{key, value})
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	respMsg, err := json.Marshal(ReadRequestMsg{reqMsg.ReqID, key, EncodeRecord(rec)})
 	if err != nil {
 		panic(err)
 	}
 	b = append(b, respMsg...)
-	log.Infof("Sending read response of key=%s and value=%s to %s", key, value, sender)
+	log.Infof("Sending read response of key=%s to %s", key, sender)
 	n.MList.SendTCP(b, sender)
 }
 
-func (n *Node) processResponseRead(msg []byte) {
+func (n *Node) processResponseRead(sender string, msg []byte) {
 	var respMsg ReadRequestMsg
 	err := json.Unmarshal(msg, &respMsg)
 	if err != nil {
 		panic(err)
 	}
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	n.opsChan[respMsg.Key] <- []byte(respMsg.Value)
+	n.Failures.Received(sender, respMsg.ReqID)
+	n.deliverResponse(respMsg.ReqID, sender, respMsg.Record)
 }
 
-func (n *Node) RequestWrite(key string, value string, to string) {
+// RequestWrite sends a write to a replica. If hintFor is set the receiver is
+// standing in for that node and keeps the write as a hint for it.
+func (n *Node) RequestWrite(reqID string, key string, rec *Record, hintFor string, to string) error {
 	var b []byte
 	b = append(b, REQUEST_WRITE)
 	b = append(b, []byte(n.Info.GetSenderName())...)
-	reqMsg, err := json.Marshal(WriteRequestMsg{key, value})
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(WriteRequestMsg{reqID, key, EncodeRecord(rec), hintFor})
 	if err != nil {
 		panic(err)
 	}
 	b = append(b, reqMsg...)
 	log.Infof("Requesting write of key=%s to %s", key, to)
-	n.MList.SendTCP(b, to)
+	return n.MList.SendTCP(b, to)
 }
 
 func (n *Node) processRequestWrite(sender string, msg []byte) {
@@ -109,44 +160,55 @@ func (n *Node) processRequestWrite(sender string, msg []byte) {
 	if err != nil {
 		panic(err)
 	}
-
-	prevVal, err := n.Engine.Read(reqMsg.Key)
+	rec, err := DecodeRecord(reqMsg.Record)
 	if err != nil {
 		panic(err)
 	}
-	if prevVal == "" || GetTimestampFromValue(prevVal) < GetTimestampFromValue(reqMsg.Value) {
-		n.Engine.Write(reqMsg.Key, reqMsg.Value)
+	if reqMsg.HintFor != "" {
+		err = n.StoreHint(reqMsg.HintFor, reqMsg.Key, rec)
+		if err != nil {
+			// Without an acknowledgement the coordinator won't count us toward quorum
+			return
+		}
+	} else {
+		_, err = n.applyRecord(reqMsg.Key, rec)
+		if err != nil {
+			panic(err)
+		}
 	}
 	var b []byte
 	b = append(b, RESPONSE_WRITE)
 	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
 	b = append(b, msg...)
 	log.Infof("Sending write response of key=%s to %s", reqMsg.Key, sender)
 	n.MList.SendTCP(b, sender)
 }
 
-func (n *Node) processResponseWrite(msg []byte) {
+func (n *Node) processResponseWrite(sender string, msg []byte) {
 	var reqMsg WriteRequestMsg
 	err := json.Unmarshal(msg, &reqMsg)
 	if err != nil {
 		panic(err)
 	}
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	n.opsChan[reqMsg.Key] <- []byte(reqMsg.Value)
+	n.Failures.Received(sender, reqMsg.ReqID)
+	n.deliverResponse(reqMsg.ReqID, sender, reqMsg.Record)
 }
 
-func (n *Node) RequestRepair(key string, value string, to string) {
+// RequestRepair sends a record to another replica, if reqID is set the
+// replica acknowledges it once applied
+func (n *Node) RequestRepair(reqID string, key string, rec *Record, to string) error {
 	var b []byte
 	b = append(b, REQUEST_REPAIR)
 	b = append(b, []byte(n.Info.GetSenderName())...)
-	reqMsg, err := json.Marshal(RepairRequestMsg{key, value})
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(RepairRequestMsg{reqID, key, EncodeRecord(rec)})
 	if err != nil {
 		panic(err)
 	}
 	b = append(b, reqMsg...)
 	log.Infof("Requesting repair of key=%s to %s", key, to)
-	n.MList.SendTCP(b, to)
+	return n.MList.SendTCP(b, to)
 }
 
 func (n *Node) processRequestRepair(sender string, msg []byte) {
@@ -155,16 +217,261 @@ func (n *Node) processRequestRepair(sender string, msg []byte) {
 	if err != nil {
 		panic(err)
 	}
-	prevVal, err := n.Engine.Read(reqMsg.Key)
+	rec, err := DecodeRecord(reqMsg.Record)
 	if err != nil {
 		panic(err)
 	}
-	if GetTimestampFromValue(reqMsg.Value) > GetTimestampFromValue(prevVal) {
-		log.Infof("Repairing key=%s with value=%s", reqMsg.Key, reqMsg.Value)
-		n.Engine.Write(reqMsg.Key, reqMsg.Value)
+	applied, err := n.applyRecord(reqMsg.Key, rec)
+	if err != nil {
+		panic(err)
+	}
+	if applied {
+		log.Infof("Repaired key=%s", reqMsg.Key)
 	} else {
-		log.Infof("Not repairing key=%s with value=%s", reqMsg.Key, reqMsg.Value)
+		log.Infof("Not repairing key=%s", reqMsg.Key)
+	}
+	if reqMsg.ReqID == "" {
+		return
+	}
+	var b []byte
+	b = append(b, RESPONSE_REPAIR)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	respMsg, err := json.Marshal(RepairRequestMsg{ReqID: reqMsg.ReqID, Key: reqMsg.Key})
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, respMsg...)
+	n.MList.SendTCP(b, sender)
+}
+
+func (n *Node) processResponseRepair(sender string, msg []byte) {
+	var respMsg RepairRequestMsg
+	err := json.Unmarshal(msg, &respMsg)
+	if err != nil {
+		panic(err)
 	}
+	n.deliverResponse(respMsg.ReqID, sender, nil)
+}
+
+// RequestMerkleHashes asks another replica for the hashes of the Merkle tree
+// nodes at paths and waits for the answer
+func (n *Node) RequestMerkleHashes(hashRange HashRange, paths []string, to string) (map[string][]byte, error) {
+	reqID, respChan := n.registerRequest(1)
+	defer n.unregisterRequest(reqID)
+
+	var b []byte
+	b = append(b, REQUEST_MERKLE)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(MerkleRequestMsg{reqID, []byte(hashRange.Low), []byte(hashRange.High), paths, nil})
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, reqMsg...)
+	log.Infof("Requesting %d merkle hashes from %s", len(paths), to)
+	n.MList.SendTCP(b, to)
+
+	select {
+	case resp := <-respChan:
+		var respMsg MerkleRequestMsg
+		err := json.Unmarshal(resp.Msg, &respMsg)
+		if err != nil {
+			return nil, err
+		}
+		return respMsg.Hashes, nil
+	case <-time.After(RepairTimeout):
+		return nil, errors.New(REPAIR_TIMEOUT)
+	}
+}
+
+func (n *Node) processRequestMerkle(sender string, msg []byte) {
+	var reqMsg MerkleRequestMsg
+	err := json.Unmarshal(msg, &reqMsg)
+	if err != nil {
+		panic(err)
+	}
+	mt := n.Engine.GetMerkleTree(HashRange{string(reqMsg.Low), string(reqMsg.High)})
+	reqMsg.Hashes = make(map[string][]byte, len(reqMsg.Paths))
+	for _, path := range reqMsg.Paths {
+		if mtn := mt.GetNode(path); mtn != nil {
+			reqMsg.Hashes[path] = []byte(mtn.Hash)
+		}
+	}
+	var b []byte
+	b = append(b, RESPONSE_MERKLE)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	respMsg, err := json.Marshal(reqMsg)
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, respMsg...)
+	log.Infof("Sending %d merkle hashes to %s", len(reqMsg.Hashes), sender)
+	n.MList.SendTCP(b, sender)
+}
+
+func (n *Node) processResponseMerkle(sender string, msg []byte) {
+	var respMsg MerkleRequestMsg
+	err := json.Unmarshal(msg, &respMsg)
+	if err != nil {
+		panic(err)
+	}
+	n.deliverResponse(respMsg.ReqID, sender, msg)
+}
+
+// RequestMerkleSync asks another replica to send us its keys in the given leaves
+func (n *Node) RequestMerkleSync(hashRange HashRange, leaves []int, to string) {
+	var b []byte
+	b = append(b, REQUEST_MERKLE_SYNC)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(MerkleSyncRequestMsg{[]byte(hashRange.Low), []byte(hashRange.High), leaves})
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, reqMsg...)
+	log.Infof("Requesting keys of %d merkle leaves from %s", len(leaves), to)
+	n.MList.SendTCP(b, to)
+}
+
+func (n *Node) processRequestMerkleSync(sender string, msg []byte) {
+	var reqMsg MerkleSyncRequestMsg
+	err := json.Unmarshal(msg, &reqMsg)
+	if err != nil {
+		panic(err)
+	}
+	hr := HashRange{string(reqMsg.Low), string(reqMsg.High)}
+	mt := n.Engine.GetMerkleTree(hr)
+	horizon := n.tombstoneHorizon(hr, n.GetRepairPeers()[hr])
+	n.Engine.StreamLeaves(mt, reqMsg.Leaves, func(key string, rec *Record) error {
+		// Would only bring back a tombstone the sender already purged
+		if rec.Purgeable(horizon) {
+			return nil
+		}
+		n.limiter.Wait()
+		n.RequestRepair("", key, rec, sender)
+		return nil
+	})
+}
+
+// RequestJoin asks the seed to add this node to the cluster
+func (n *Node) RequestJoin(seedNode *NodeInfo) {
+	var b []byte
+	b = append(b, REQUEST_JOIN)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(JoinRequestMsg{n.Info})
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, reqMsg...)
+	log.Infof("Requesting to join from %s", seedNode.Name)
+	n.MList.SendTCP(b, seedNode.Name)
+}
+
+func (n *Node) processRequestJoin(sender string, msg []byte) {
+	var reqMsg JoinRequestMsg
+	err := json.Unmarshal(msg, &reqMsg)
+	if err != nil {
+		panic(err)
+	}
+	if n.Config == nil {
+		return
+	}
+	err = n.AdmitNode(reqMsg.Node)
+	if err != nil {
+		log.Warnf("Not admitting %s: %s", reqMsg.Node.Name, err)
+		return
+	}
+	n.SendConfig(sender)
+}
+
+// RequestJoinComplete tells the seed this node has streamed all its ranges
+func (n *Node) RequestJoinComplete(seedNode *NodeInfo) {
+	var b []byte
+	b = append(b, REQUEST_JOIN_COMPLETE)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(JoinRequestMsg{n.Info})
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, reqMsg...)
+	log.Infof("Reporting join complete to %s", seedNode.Name)
+	n.MList.SendTCP(b, seedNode.Name)
+}
+
+func (n *Node) processRequestJoinComplete(sender string, msg []byte) {
+	var reqMsg JoinRequestMsg
+	err := json.Unmarshal(msg, &reqMsg)
+	if err != nil {
+		panic(err)
+	}
+	err = n.CompleteJoin(reqMsg.Node.Name)
+	if err != nil {
+		log.Warnf("Not completing join of %s: %s", reqMsg.Node.Name, err)
+		return
+	}
+	n.SendConfig(sender)
+}
+
+// RequestStream asks a replica to send us every key in hashRange. The replica
+// answers once all keys were sent and acknowledged.
+func (n *Node) RequestStream(reqID string, hashRange HashRange, to string) error {
+	var b []byte
+	b = append(b, REQUEST_STREAM)
+	b = append(b, []byte(n.Info.GetSenderName())...)
+	b = append(b, []byte(n.Clock.Now().Encode())...)
+	reqMsg, err := json.Marshal(StreamRequestMsg{ReqID: reqID, Low: []byte(hashRange.Low), High: []byte(hashRange.High)})
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, reqMsg...)
+	log.Infof("Requesting range %s from %s", merkleRangeID(hashRange), to)
+	return n.MList.SendTCP(b, to)
+}
+
+func (n *Node) processRequestStream(sender string, msg []byte) {
+	var reqMsg StreamRequestMsg
+	err := json.Unmarshal(msg, &reqMsg)
+	if err != nil {
+		panic(err)
+	}
+	// Streaming waits for acknowledgements, which arrive through this handler
+	go func() {
+		// A joining node may not have been gossiped to us yet
+		if !n.MList.WaitForNode(sender, MemberWaitTimeout) {
+			log.Warnf("Not streaming to unknown node %s", sender)
+			return
+		}
+		hr := HashRange{string(reqMsg.Low), string(reqMsg.High)}
+		keys, err := n.StreamRange(hr, sender)
+		reqMsg.Keys = keys
+		if err != nil {
+			reqMsg.Error = err.Error()
+		}
+		var b []byte
+		b = append(b, RESPONSE_STREAM)
+		b = append(b, []byte(n.Info.GetSenderName())...)
+		b = append(b, []byte(n.Clock.Now().Encode())...)
+		respMsg, err := json.Marshal(reqMsg)
+		if err != nil {
+			panic(err)
+		}
+		b = append(b, respMsg...)
+		log.Infof("Streamed %d keys of range %s to %s", reqMsg.Keys, merkleRangeID(hr), sender)
+		n.MList.SendTCP(b, sender)
+	}()
+}
+
+func (n *Node) processResponseStream(sender string, msg []byte) {
+	var respMsg StreamRequestMsg
+	err := json.Unmarshal(msg, &respMsg)
+	if err != nil {
+		panic(err)
+	}
+	n.deliverResponse(respMsg.ReqID, sender, msg)
 }
 
 // Types of messages
@@ -176,21 +483,65 @@ const (
 	RESPONSE_READ
 	RESPONSE_WRITE
 	REQUEST_REPAIR
+	REQUEST_MERKLE
+	RESPONSE_MERKLE
+	REQUEST_MERKLE_SYNC
+	RESPONSE_REPAIR
+	REQUEST_JOIN
+	REQUEST_JOIN_COMPLETE
+	REQUEST_STREAM
+	RESPONSE_STREAM
+	CONFIG_VERSION
 )
 
 // TODO: find a better way to serialize/deserialize than json
 
+// ReqID is echoed back by replicas so responses reach the right coordinator
+// request. Record holds an encoded Record, empty if the key is not stored.
 type ReadRequestMsg struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	ReqID  string `json:"req_id"`
+	Key    string `json:"key"`
+	Record []byte `json:"record"`
 }
 
 type WriteRequestMsg struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	ReqID   string `json:"req_id"`
+	Key     string `json:"key"`
+	Record  []byte `json:"record"`
+	HintFor string `json:"hint_for,omitempty"` // intended replica when sent to a stand-in
 }
 
 type RepairRequestMsg struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	ReqID  string `json:"req_id"`
+	Key    string `json:"key"`
+	Record []byte `json:"record"`
+}
+
+// Hash range bounds and hashes are raw bytes, which json would mangle as strings.
+// Hashes is only set in responses and maps tree paths to node hashes.
+type MerkleRequestMsg struct {
+	ReqID  string            `json:"req_id"`
+	Low    []byte            `json:"low"`
+	High   []byte            `json:"high"`
+	Paths  []string          `json:"paths"`
+	Hashes map[string][]byte `json:"hashes"`
+}
+
+type MerkleSyncRequestMsg struct {
+	Low    []byte `json:"low"`
+	High   []byte `json:"high"`
+	Leaves []int  `json:"leaves"`
+}
+
+type JoinRequestMsg struct {
+	Node *NodeInfo `json:"node"`
+}
+
+// Keys and Error are only set in responses
+type StreamRequestMsg struct {
+	ReqID string `json:"req_id"`
+	Low   []byte `json:"low"`
+	High  []byte `json:"high"`
+	Keys  int    `json:"keys"`
+	Error string `json:"error,omitempty"`
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version is the build version, set with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// NodeMeta is the metadata every node advertises through the membership. It is
+// kept small, the membership limits it to 512 bytes.
+type NodeMeta struct {
+	APIAddr   string     `json:"api"`
+	Version   string     `json:"ver"`
+	Zone      string     `json:"zone,omitempty"`
+	Status    NodeStatus `json:"st,omitempty"`
+	Keys      uint64     `json:"keys"` // see EngineStats
+	LSMBytes  int64      `json:"lsm"`
+	VLogBytes int64      `json:"vlog"`
+}
+
+// LocalMeta returns the current metadata of this node
+func (n *Node) LocalMeta() *NodeMeta {
+	meta := &NodeMeta{
+		APIAddr: n.Info.Addr + ":" + n.Info.APIPort,
+		Version: Version,
+		Zone:    n.Info.Zone,
+	}
+	if n.Config != nil {
+		meta.Zone = n.LocalZone()
+		if self := n.Config.GetNode(n.Info.Name); self != nil {
+			meta.Status = self.Status
+		}
+	}
+	stats := n.Engine.Stats()
+	meta.Keys, meta.LSMBytes, meta.VLogBytes = stats.Keys, stats.LSMBytes, stats.VLogBytes
+	return meta
+}
+
+// encodeMeta is called by the membership whenever it advertises this node
+func (n *Node) encodeMeta(limit int) []byte {
+	b, err := json.Marshal(n.LocalMeta())
+	if err != nil {
+		panic(err)
+	}
+	if len(b) > limit {
+		log.Warnf("Node metadata of %d bytes exceeds the limit of %d", len(b), limit)
+		return nil
+	}
+	return b
+}
+
+// onNodeMeta records the metadata advertised by another node
+func (n *Node) onNodeMeta(name string, b []byte) {
+	if len(b) == 0 || n.Router == nil {
+		return
+	}
+	var meta NodeMeta
+	err := json.Unmarshal(b, &meta)
+	if err != nil {
+		log.Warnf("Invalid metadata from %s: %s", name, err)
+		return
+	}
+	n.Router.SetNodeMeta(name, &meta)
+}
+
+func (n *Node) advertiseMeta() {
+	if n.Router != nil {
+		n.Router.SetNodeMeta(n.Info.Name, n.LocalMeta())
+	}
+	err := n.MList.UpdateNode()
+	if err != nil {
+		log.Debugf("Could not advertise node metadata: %s", err)
+	}
+}
+
+const (
+	MetaAdvertiseInterval = 10 * time.Second
+)
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"strconv"
+	"time"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
@@ -9,10 +11,13 @@ import (
 
 // MemberList is a wrapper around the memberlist package
 type MemberList struct {
-	List *memberlist.Memberlist
+	List       *memberlist.Memberlist
+	broadcasts *memberlist.TransmitLimitedQueue
 }
 
-func CreateMemberList(node *NodeInfo, seedNode *NodeInfo, processMsg func(b []byte)) (m *MemberList) {
+// CreateMemberList starts gossiping as node, the delegate and events receive
+// messages, cluster state and membership changes
+func CreateMemberList(node *NodeInfo, delegate *MemberListDelegate, events *MemberListEvents) (m *MemberList) {
 	port, err := strconv.Atoi(node.Port)
 	if err != nil {
 		panic(err)
@@ -22,9 +27,8 @@ func CreateMemberList(node *NodeInfo, seedNode *NodeInfo, processMsg func(b []by
 	config.BindPort = port
 	config.AdvertisePort = port
 	config.Name = node.Name
-	config.Delegate = &MemberListDelegate{
-		ProcessMsg: processMsg,
-	}
+	config.Delegate = delegate
+	config.Events = events
 	config.LogOutput = logrus.StandardLogger().WriterLevel(logrus.DebugLevel)
 
 	list, err := memberlist.Create(config)
@@ -32,21 +36,56 @@ func CreateMemberList(node *NodeInfo, seedNode *NodeInfo, processMsg func(b []by
 		panic(err)
 	}
 
-	if seedNode != nil {
-		addr := seedNode.Addr + ":" + seedNode.Port
-		_, err := list.Join([]string{addr})
-		if err != nil {
-			panic(err)
-		}
-	}
-
 	m = &MemberList{
 		List: list,
+		broadcasts: &memberlist.TransmitLimitedQueue{
+			NumNodes:       list.NumMembers,
+			RetransmitMult: config.RetransmitMult,
+		},
 	}
+	delegate.broadcasts = m.broadcasts
 
 	return m
 }
 
+// Meta returns the metadata last advertised by every alive member
+func (m *MemberList) Meta() map[string][]byte {
+	meta := make(map[string][]byte)
+	for _, member := range m.List.Members() {
+		meta[member.Name] = member.Meta
+	}
+	return meta
+}
+
+// UpdateNode advertises the local node's metadata again
+func (m *MemberList) UpdateNode() error {
+	return m.List.UpdateNode(UpdateNodeTimeout)
+}
+
+// Join joins the cluster through the seed node, exchanging cluster state with it
+func (m *MemberList) Join(seedNode *NodeInfo) error {
+	_, err := m.List.Join([]string{seedNode.Addr + ":" + seedNode.Port})
+	return err
+}
+
+// Broadcast gossips msg to every member. A queued message is dropped when a
+// newer one with the same name is broadcast.
+func (m *MemberList) Broadcast(name string, msg []byte) {
+	m.broadcasts.QueueBroadcast(&broadcast{name: name, msg: msg})
+}
+
+func (m *MemberList) Members() []Member {
+	var members []Member
+	for _, member := range m.List.Members() {
+		state := ALIVE
+		if member.State == memberlist.StateSuspect {
+			state = SUSPECT
+		}
+		members = append(members, Member{Name: member.Name, State: state})
+	}
+	return members
+}
+
 func (m *MemberList) CheckIfNodeAlive(node *NodeInfo) bool {
 	for _, member := range m.List.Members() {
 		if member.Name == node.Name {
@@ -65,28 +104,56 @@ func (m *MemberList) FindNode(name string) (node *memberlist.Node) {
 	return nil
 }
 
-func (m *MemberList) SendTCP(msg []byte, name string) {
+// Leave tells the other members this node is leaving and stops gossiping
+func (m *MemberList) Leave() error {
+	err := m.List.Leave(LeaveTimeout)
+	if err != nil {
+		return err
+	}
+	return m.List.Shutdown()
+}
+
+// WaitForNode waits until the named node is a known member
+func (m *MemberList) WaitForNode(name string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for m.FindNode(name) == nil {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func (m *MemberList) SendTCP(msg []byte, name string) error {
 	node := m.FindNode(name)
-	if node != nil {
-		m.List.SendReliable(node, msg)
+	if node == nil {
+		return errors.New(NODE_UNREACHABLE)
 	}
+	return m.List.SendReliable(node, msg)
 }
 
-func (m *MemberList) SendUDP(msg []byte, name string) {
+func (m *MemberList) SendUDP(msg []byte, name string) error {
 	node := m.FindNode(name)
-	if node != nil {
-		m.List.SendBestEffort(node, msg)
+	if node == nil {
+		return errors.New(NODE_UNREACHABLE)
 	}
+	return m.List.SendBestEffort(node, msg)
 }
 
+// MemberListDelegate hands user messages to ProcessMsg, advertises the
+// metadata returned by GetMeta and exchanges the state returned by GetState
+// with other members through push/pull syncs
 type MemberListDelegate struct {
 	ProcessMsg func([]byte)
+	GetMeta    func(limit int) []byte
+	GetState   func() []byte
+	MergeState func([]byte)
+	broadcasts *memberlist.TransmitLimitedQueue
 }
 
-// TODO: Implement these methods
-
 func (d *MemberListDelegate) NodeMeta(limit int) []byte {
-	return []byte{}
+	return d.GetMeta(limit)
 }
 
 func (d *MemberListDelegate) NotifyMsg(b []byte) {
@@ -94,15 +161,57 @@ func (d *MemberListDelegate) NotifyMsg(b []byte) {
 }
 
 func (d *MemberListDelegate) GetBroadcasts(overhead, limit int) [][]byte {
-	return [][]byte{}
+	if d.broadcasts == nil {
+		return nil
+	}
+	return d.broadcasts.GetBroadcasts(overhead, limit)
 }
 
 func (d *MemberListDelegate) LocalState(join bool) []byte {
-	return []byte{}
+	return d.GetState()
 }
 
 func (d *MemberListDelegate) MergeRemoteState(buf []byte, join bool) {
-	println("MergeRemoteState", string(buf))
+	if len(buf) > 0 {
+		d.MergeState(buf)
+	}
+}
+
+// broadcast is a message gossiped through the TransmitLimitedQueue
+type broadcast struct {
+	name string
+	msg  []byte
+}
+
+func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*broadcast)
+	return ok && o.name == b.name
+}
+
+func (b *broadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *broadcast) Finished() {}
+
+// MemberListEvents is notified by memberlist about membership changes
+type MemberListEvents struct {
+	OnJoin  func(name string)
+	OnLeave func(name string) // the node failed or left
+	OnMeta  func(name string, meta []byte)
+}
+
+func (e *MemberListEvents) NotifyJoin(node *memberlist.Node) {
+	e.OnMeta(node.Name, node.Meta)
+	e.OnJoin(node.Name)
+}
+
+func (e *MemberListEvents) NotifyLeave(node *memberlist.Node) {
+	e.OnLeave(node.Name)
+}
+
+func (e *MemberListEvents) NotifyUpdate(node *memberlist.Node) {
+	e.OnMeta(node.Name, node.Meta)
 }
 
 func PadName(name string) string {
@@ -111,3 +220,8 @@ func PadName(name string) string {
 	}
 	return name
 }
+
+const (
+	LeaveTimeout      = 5 * time.Second
+	UpdateNodeTimeout = 5 * time.Second
+)
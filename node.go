@@ -1,72 +1,246 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Node struct {
-	MList    *MemberList
-	Config   *Config
-	Info     *NodeInfo
-	Engine   *Engine
-	Router   *Router
-	Server   *APIServer
-	opsChan  map[string]chan []byte
-	opsMutex map[string]*sync.RWMutex
-	mu       sync.Mutex
+	MList     Membership
+	Config    *Config
+	Info      *NodeInfo
+	Clock     *HLC
+	Engine    *Engine
+	Router    *Router
+	Server    *APIServer
+	Repairs   *RepairScheduler
+	Liveness  *LivenessView
+	Failures  *PhiDetector
+	limiter   *RateLimiter              // bounds keys sent by anti-entropy repair
+	requests  map[string]chan *Response // in-flight coordinator requests by request ID
+	replaying map[string]bool           // targets whose hints are being replayed
+	seed      *NodeInfo                 // node that admitted this one to the cluster
+	moving    bool                      // whether a bootstrap or handoff is running
+	repairing int32                     // 1 while a manual repair runs
+	reqSeq    uint64
+	bootTime  int64
+	stop      chan struct{}  // closed by Shutdown
+	loops     sync.WaitGroup // background loops, see runEvery
+	mu        sync.Mutex
+	changes   []func(cfg *Config) error // config changes made since the last install, see UpdateConfig
+	cfgMu     sync.Mutex                // serializes config changes
 }
 
 type NodeInfo struct {
-	Name         string `json:"name"`
-	Addr         string `json:"addr"`
-	Port         string `json:"port"`
-	APIPort      string `json:"api_port"`
-	NodeHash     string `json:"node_hash"`
-	PrevNodeHash string `json:"prev_node_hash"`
-	NextNodeHash string `json:"next_node_hash"`
+	Name      string     `json:"name"`
+	Addr      string     `json:"addr"`
+	Port      string     `json:"port"`
+	APIPort   string     `json:"api_port"`
+	Tokens    Tokens     `json:"tokens"`               // positions of the node's vnodes on the ring
+	Weight    float64    `json:"weight"`               // relative capacity, 0 counts as 1
+	NewWeight float64    `json:"new_weight,omitempty"` // weight the node is moving its ranges to, see SetWeight
+	Zone      string     `json:"zone"`                 // rack or availability zone
+	Status    NodeStatus `json:"status,omitempty"`
+	Replaces  string     `json:"replaces,omitempty"` // dead node whose tokens a joining node takes over
 }
 
-func (ni *NodeInfo) GetHash() string {
-	if ni.NodeHash == "" {
-		ni.NodeHash = GenerateHash(ni.Name)
+// NodeStatus is the stage of a node's membership, empty counts as NORMAL
+type NodeStatus string
+
+const (
+	NORMAL  NodeStatus = "NORMAL"  // Owns its ranges
+	JOINING NodeStatus = "JOINING" // Receives writes while streaming its ranges, owns nothing yet
+	LEAVING NodeStatus = "LEAVING" // Still owns its ranges while streaming them to their next owners
+)
+
+// IsOwner reports whether the node serves its ranges
+func (ni *NodeInfo) IsOwner() bool {
+	return ni.Status != JOINING
+}
+
+// Tokens are raw SHA256 hashes, hex encoded in json
+type Tokens []string
+
+func (t Tokens) MarshalJSON() ([]byte, error) {
+	encoded := make([]string, len(t))
+	for i, token := range t {
+		encoded[i] = hex.EncodeToString([]byte(token))
+	}
+	return json.Marshal(encoded)
+}
+
+func (t *Tokens) UnmarshalJSON(b []byte) error {
+	var encoded []string
+	err := json.Unmarshal(b, &encoded)
+	if err != nil {
+		return err
+	}
+	*t = make(Tokens, len(encoded))
+	for i, e := range encoded {
+		token, err := hex.DecodeString(e)
+		if err != nil {
+			return err
+		}
+		(*t)[i] = string(token)
+	}
+	return nil
+}
+
+// Copy returns a copy of the node info that can be changed without affecting ni
+func (ni *NodeInfo) Copy() *NodeInfo {
+	c := *ni
+	c.Tokens = append(Tokens(nil), ni.Tokens...)
+	return &c
+}
+
+// TokenCount returns how many tokens the node should own given the number of
+// tokens of a node with weight 1
+func (ni *NodeInfo) TokenCount(vnodes int) int {
+	weight := ni.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	count := int(math.Round(float64(vnodes) * weight))
+	if count < 1 {
+		count = 1
+	}
+	return count
+}
+
+// AssignTokens grows or shrinks the node's tokens to count. New tokens are
+// derived from the node's name, the first one being the hash of the name, so
+// changing the count only moves the ranges of the added or removed tokens.
+func (ni *NodeInfo) AssignTokens(count int) {
+	if len(ni.Tokens) > count {
+		ni.Tokens = ni.Tokens[:count]
 	}
-	return ni.NodeHash
+	for i := len(ni.Tokens); i < count; i++ {
+		if i == 0 {
+			ni.Tokens = append(ni.Tokens, GenerateHash(ni.Name))
+		} else {
+			ni.Tokens = append(ni.Tokens, GenerateHash(ni.Name+"#"+strconv.Itoa(i)))
+		}
+	}
+}
+
+// StartNode starts a node configured by local, seeding a new cluster with
+// config or joining the cluster of seedNode
+func StartNode(config *Config, currNode *NodeInfo, seedNode *NodeInfo, local *LocalConfig) *Node {
+	return startNode(config, currNode, seedNode, local, func(delegate *MemberListDelegate, events *MemberListEvents) Membership {
+		return CreateMembership(local.Membership, currNode, delegate, events)
+	})
 }
 
-func StartNode(config *Config, currNode *NodeInfo, seedNode *NodeInfo) *Node {
+// startNode is StartNode with the membership created by createMembership,
+// tests pass a fake one
+func startNode(config *Config, currNode *NodeInfo, seedNode *NodeInfo, local *LocalConfig, createMembership func(delegate *MemberListDelegate, events *MemberListEvents) Membership) *Node {
 	var n Node
-	n.MList = CreateMemberList(currNode, seedNode, n.ProcessMsg)
 	n.Info = currNode
-	n.Engine = CreateEngine(n.Info.Name)
-	n.Info.GetHash()
+	n.Clock = NewHLC(currNode.Name)
+	local.LogSummary(n.Info.Name)
+	n.Engine = CreateEngine(OpenStorage(local, n.Info.Name))
+	n.requests = make(map[string]chan *Response)
+	n.replaying = make(map[string]bool)
+	n.Liveness = NewLivenessView()
+	n.Failures = NewPhiDetector()
+	n.limiter = NewRateLimiter(0)
+	n.bootTime = time.Now().UnixNano()
+	n.MList = createMembership(&MemberListDelegate{
+		ProcessMsg: n.ProcessMsg,
+		GetMeta:    n.encodeMeta,
+		GetState:   n.configState,
+		MergeState: n.mergeConfigState,
+	}, &MemberListEvents{
+		OnJoin:  n.onNodeJoin,
+		OnLeave: n.onNodeLeave,
+		OnMeta:  n.onNodeMeta,
+	})
+	n.stop = make(chan struct{})
+	n.runEvery(LivenessCheckInterval, n.checkSuspicions)
 	n.Server = InitServer(n.Info, n.Read, n.Write, n.Delete, n.Repair)
-	n.opsChan = make(map[string]chan []byte)
-	n.opsMutex = make(map[string]*sync.RWMutex)
+	n.Server.AddHandler("/repair/status", n.repairStatusHandler)
+	n.Server.AddHandler("/admin/ownership", n.ownershipHandler)
+	n.Server.AddHandler("/admin/decommission", n.decommissionHandler)
+	n.Server.AddHandler("/admin/weight", n.weightHandler)
+	n.Server.AddHandler("/admin/cluster", n.clusterHandler)
+	n.Server.AddHandler("/admin/failure-detector", n.failureDetectorHandler)
 	if config == nil {
-		n.RequestConfigRep(seedNode)
+		n.seed = seedNode
+		err := n.MList.Join(seedNode)
+		if err != nil {
+			// Membership implementations can't talk to each other
+			panic(fmt.Sprintf("Could not join through %s, it must be up and use %s membership: %s", seedNode.Name, local.Membership, err))
+		}
+		n.RequestJoinRep(seedNode)
 	} else {
-		n.Config = config
-		n.Router = CreateRouter(config)
-		n.Config.State = STABLE
+		config.AssignTokens()
+		n.SetConfig(config)
 	}
 	log.Infof("Node %s started", n.Info.Name)
 	return &n
 }
 
-func (n *Node) RequestConfigRep(seedNode *NodeInfo) {
-	n.RequestConfig(seedNode)
-	time.Sleep(1 * time.Second)
-	if n.Config == nil {
-		n.RequestConfigRep(seedNode)
+// SetConfig installs the cluster config and starts everything depending on it
+func (n *Node) SetConfig(config *Config) {
+	n.Config = config
+	if n.Router == nil {
+		n.Router = CreateRouter(config)
+		// Metadata is only reported when it changes, pick up what was advertised so far
+		for name, meta := range n.MList.Meta() {
+			n.onNodeMeta(name, meta)
+		}
+	} else {
+		n.Router.Update(config)
+	}
+	n.Engine.TrackRanges(n.Router.GetHashRangesForNode(n.Info.Name), n.Config.MerkleDepth)
+	// Repairs may be waiting on the limiter, so it is updated rather than replaced
+	n.limiter.SetRate(config.RepairKeysPerSec)
+	if n.Repairs != nil {
+		n.Repairs.SetConcurrency(config.RepairConcurrency)
+	} else {
+		n.Repairs = CreateRepairScheduler(n)
+		n.Repairs.Start()
+		n.runEvery(HintReplayInterval, n.replayAllHints)
+		n.runEvery(TombstoneGCInterval, n.CollectTombstones)
+		// Re-advertised so other nodes see current storage stats
+		n.runEvery(MetaAdvertiseInterval, n.advertiseMeta)
 	}
 }
 
-func (ni *NodeInfo) CheckIfHashInRange(hash string) bool {
-	return CheckIfHashInHashRange(hash, HashRange{Low: ni.PrevNodeHash, High: ni.NodeHash})
+// runEvery calls f every interval in the background until the node shuts down
+func (n *Node) runEvery(interval time.Duration, f func()) {
+	n.loops.Add(1)
+	go func() {
+		defer n.loops.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-n.stop:
+				return
+			}
+		}
+	}()
+}
+
+// RequestJoinRep asks the seed to add this node until it is in the config
+func (n *Node) RequestJoinRep(seedNode *NodeInfo) {
+	n.RequestJoin(seedNode)
+	time.Sleep(1 * time.Second)
+	if n.Config == nil || n.Config.GetNode(n.Info.Name) == nil {
+		n.RequestJoinRep(seedNode)
+	}
 }
 
 // 8 character name, optionally padded with 0s
@@ -76,98 +250,240 @@ func (ni *NodeInfo) GetSenderName() string {
 
 // TODO: make this concurrent
 
-func (n *Node) Read(key string) (value string, err error) {
+// ReadResult holds the live values of a key. Keys in vector clock keyspaces
+// may have several concurrent values and a causal context to pass to the
+// next write.
+type ReadResult struct {
+	Values  []string
+	Context string
+}
+
+// WriteOptions are per request settings of a write or delete
+type WriteOptions struct {
+	Context string // causal context from a previous read, vector clock keyspaces only
+	Sloppy  bool   // let alive nodes past the preferred replicas stand in for dead ones
+}
+
+func (n *Node) Read(key string) (result *ReadResult, err error) {
 	log.Infof("Read request for key=%s", key)
-	if n.Config.State != STABLE {
-		return "", errors.New(CLUSTER_NOT_STABLE)
+	if n.Config == nil {
+		return nil, errors.New(CLUSTER_NOT_STABLE)
 	}
-
-	m, ok := n.opsMutex[key]
-	if !ok {
-		m = &sync.RWMutex{}
-		n.opsMutex[key] = m
+	// Internal keys hold Merkle trees and hints, clients must not touch them
+	if IsInternalKey(key) {
+		return nil, errors.New(INVALID_KEY)
+	}
+	// A joining node may coordinate reads only once it holds its ranges
+	if self := n.Config.GetNode(n.Info.Name); self != nil && self.Status == JOINING {
+		return nil, errors.New(NODE_BOOTSTRAPPING)
 	}
-	m.RLock()
-	defer m.RUnlock()
-	n.mu.Lock()
-	n.opsChan[key] = make(chan []byte, n.Config.ReplicationFactor)
-	n.mu.Unlock()
 
-	readNum := 0
 	nodesWithKey := n.Router.GetNodesInRange(key, n.Config.ReplicationFactor)
-	for _, node := range nodesWithKey {
-		n.RequestRead(key, node.Name)
+	quorum := n.NewQuorum(nodesWithKey, n.Config.MinReadsRequired)
+	// Dead and suspected replicas would only make us wait for the timeout
+	targets := n.selectReplicas(nodesWithKey, quorum)
+	if !quorum.Possible(targets) {
+		return nil, errors.New(NOT_ENOUGH_REPLICAS)
 	}
-	var latestValue, lastTimestamp string
-	for {
+
+	reqID, respChan := n.registerRequest(len(targets))
+	for _, node := range targets {
+		n.Failures.Sent(node.Name, reqID)
+		n.RequestRead(reqID, key, node.Name)
+	}
+	reads := &readState{key: key, replicas: len(targets), responses: make(map[string]*Record)}
+	timeout := time.After(ReadTimeout)
+	for !quorum.Reached() {
 		select {
-		case msg := <-n.opsChan[key]:
-			readNum++
-			ts := GetTimestampFromValue(string(msg))
-			if ts != "" && (lastTimestamp == "" || lastTimestamp < ts) {
-				latestValue = GetValueTextFromValue(string(msg))
-				lastTimestamp = ts
-			}
-			if readNum >= n.Config.MinReadsRequired {
-				if latestValue != DeletedHash && latestValue != "" {
-					return latestValue, nil
-				} else {
-					return "", errors.New(KEY_NOT_FOUND)
-				}
-			}
-		case <-time.After(ReadTimeout):
-			return "", errors.New(READ_TIMEOUT)
+		case resp := <-respChan:
+			n.collectRead(reads, resp)
+			quorum.Add(resp.From)
+		case <-timeout:
+			n.unregisterRequest(reqID)
+			return nil, errors.New(READ_TIMEOUT)
 		}
+	}
 
+	switch n.Config.ReadRepair {
+	case SYNC_READ_REPAIR:
+		n.readRepair(reqID, respChan, reads)
+	case ASYNC_READ_REPAIR:
+		result, err = readResultOf(reads.latest)
+		go n.readRepair(reqID, respChan, reads)
+		return result, err
+	default:
+		n.unregisterRequest(reqID)
 	}
+	return readResultOf(reads.latest)
 }
 
-func (n *Node) Write(key string, value string) (err error) {
+func readResultOf(rec *Record) (*ReadResult, error) {
+	if !rec.Live() {
+		return nil, errors.New(KEY_NOT_FOUND)
+	}
+	result := &ReadResult{Context: EncodeContext(History(rec))}
+	for _, s := range siblingsOf(rec) {
+		if s.Live() {
+			result.Values = append(result.Values, string(s.Value))
+		}
+	}
+	return result, nil
+}
+
+func (n *Node) Write(key string, value string, opts WriteOptions) (err error) {
 	log.Infof("Write request for key=%s", key)
-	if n.Config.State != STABLE {
+	return n.writeRecord(key, &Record{
+		Timestamp: n.Clock.Now(),
+		Origin:    n.Info.Name,
+		Value:     []byte(value),
+	}, opts)
+}
+
+func (n *Node) Delete(key string, opts WriteOptions) (err error) {
+	log.Infof("Delete request for key=%s", key)
+	return n.writeRecord(key, &Record{
+		Timestamp: n.Clock.Now(),
+		Origin:    n.Info.Name,
+		Tombstone: true,
+	}, opts)
+}
+
+func (n *Node) writeRecord(key string, rec *Record, opts WriteOptions) (err error) {
+	if n.Config == nil {
 		return errors.New(CLUSTER_NOT_STABLE)
 	}
+	if IsInternalKey(key) {
+		return errors.New(INVALID_KEY)
+	}
+	if n.Config.VersioningFor(key) == VECTOR_CLOCK {
+		ctx, err := DecodeContext(opts.Context)
+		if err != nil {
+			return err
+		}
+		// The context holds dots of this node's earlier writes, a new dot
+		// below them means the clock went back and the write would be lost
+		if ctx[n.Info.Name] >= DotCounter(rec.Timestamp) {
+			return errors.New(CONTEXT_AHEAD)
+		}
+		rec.VClock = ctx
+	}
 
-	m, ok := n.opsMutex[key]
-	if !ok {
-		m = &sync.RWMutex{}
-		n.opsMutex[key] = m
+	var nodesWithKey []*NodeInfo
+	standIns := make(map[string]string)
+	if opts.Sloppy {
+		nodesWithKey, standIns = n.Router.GetSloppyNodesInRange(key, n.Config.ReplicationFactor, n.MList.CheckIfNodeAlive)
+	} else {
+		nodesWithKey = n.Router.GetNodesInRange(key, n.Config.ReplicationFactor)
+	}
+	pending := n.Router.GetPendingNodesInRange(key)
+	quorum := n.NewQuorum(nodesWithKey, n.Config.MinWritesRequired)
+	targets := n.selectReplicas(nodesWithKey, quorum)
+	if !quorum.Possible(targets) {
+		return errors.New(NOT_ENOUGH_REPLICAS)
+	}
+	// Skipped replicas get the write as a hint
+	send := make(map[string]bool)
+	for _, node := range append(targets, n.withoutDead(pending)...) {
+		send[node.Name] = true
 	}
-	m.Lock()
-	defer m.Unlock()
-	n.mu.Lock()
-	n.opsChan[key] = make(chan []byte, n.Config.ReplicationFactor)
-	n.mu.Unlock()
 
-	writeNum := 0
-	value = AddTimestampToValue(value)
-	nodesWithKey := n.Router.GetNodesInRange(key, n.Config.ReplicationFactor)
-	for _, node := range nodesWithKey {
-		n.RequestWrite(key, value, node.Name)
+	reqID, respChan := n.registerRequest(len(nodesWithKey) + len(pending))
+	defer n.unregisterRequest(reqID)
+
+	for _, node := range append(append([]*NodeInfo{}, nodesWithKey...), pending...) {
+		err := errors.New(NODE_UNREACHABLE)
+		if send[node.Name] {
+			n.Failures.Sent(node.Name, reqID)
+			err = n.RequestWrite(reqID, key, rec, standIns[node.Name], node.Name)
+		}
+		if err != nil {
+			log.Warnf("Could not send write of key=%s to %s: %s", key, node.Name, err)
+			owner := node.Name
+			if standIns[node.Name] != "" {
+				owner = standIns[node.Name]
+			}
+			n.StoreHint(owner, key, rec)
+		}
 	}
+	timeout := time.After(WriteTimeout)
 	for {
 		select {
-		case <-n.opsChan[key]:
-			writeNum++
-			if writeNum >= n.Config.MinWritesRequired {
+		case resp := <-respChan:
+			if quorum.Add(resp.From) {
 				return nil
 			}
-		case <-time.After(WriteTimeout):
+		case <-timeout:
 			return errors.New(CLUSTER_NOT_STABLE)
 		}
 	}
 }
 
-func (n *Node) Delete(key string) (err error) {
-	return n.Write(key, DeletedHash)
+// reconcile combines two versions of a key according to its keyspace's versioning
+func (n *Node) reconcile(key string, a, b *Record) *Record {
+	if n.Config.VersioningFor(key) == VECTOR_CLOCK {
+		return MergeSiblings(a, b)
+	}
+	return NewerRecord(a, b)
+}
+
+// Response is a reply to a coordinator request
+type Response struct {
+	From string // padded name of the replica
+	Msg  []byte
+}
+
+// registerRequest allocates a unique request ID and the channel on which
+// replica responses carrying that ID are delivered
+func (n *Node) registerRequest(size int) (string, chan *Response) {
+	seq := atomic.AddUint64(&n.reqSeq, 1)
+	reqID := fmt.Sprintf("%s-%x-%d", n.Info.Name, n.bootTime, seq)
+	ch := make(chan *Response, size)
+	n.mu.Lock()
+	n.requests[reqID] = ch
+	n.mu.Unlock()
+	return reqID, ch
+}
+
+// unregisterRequest removes a finished request so late responses are dropped
+func (n *Node) unregisterRequest(reqID string) {
+	n.mu.Lock()
+	delete(n.requests, reqID)
+	n.mu.Unlock()
+}
+
+// deliverResponse hands a replica response to the request waiting on it
+func (n *Node) deliverResponse(reqID string, from string, msg []byte) {
+	n.mu.Lock()
+	ch, ok := n.requests[reqID]
+	n.mu.Unlock()
+	if !ok {
+		log.Debugf("Dropping response for unknown request %s", reqID)
+		return
+	}
+	select {
+	case ch <- &Response{From: from, Msg: msg}:
+	default:
+		log.Warnf("Dropping extra response for request %s", reqID)
+	}
+}
+
+// applyRecord reconciles rec with the stored record for key and stores the
+// result if it changed
+func (n *Node) applyRecord(key string, rec *Record) (applied bool, err error) {
+	return n.Engine.Merge(key, func(prev *Record) *Record {
+		return n.reconcile(key, prev, rec)
+	})
 }
 
 func (n *Node) Repair(otherNode string) (err error) {
 	log.Infof("Repair request for node=%s", otherNode)
-	if n.Config.State != STABLE {
+	if n.Config == nil {
 		return errors.New(CLUSTER_NOT_STABLE)
 	}
-	n.Config.State = UNSTABLE
+	if !atomic.CompareAndSwapInt32(&n.repairing, 0, 1) {
+		return errors.New(REPAIR_RUNNING)
+	}
+	defer atomic.StoreInt32(&n.repairing, 0)
 	hashRanges := n.Router.GetHashRangesForRepair(n.Info.Name, otherNode)
 	for _, hashRange := range hashRanges {
 		err := n.RepairHashRange(otherNode, hashRange)
@@ -175,23 +491,67 @@ func (n *Node) Repair(otherNode string) (err error) {
 			return err
 		}
 	}
-	n.Config.State = STABLE
 	return nil
 }
 
+// RepairHashRange runs Merkle tree anti-entropy with otherNode over hashRange.
+// Both trees are compared level by level, descending only into subtrees whose
+// hashes differ, and the keys of mismatching leaves are sent in both directions.
 func (n *Node) RepairHashRange(otherNode string, hashRange HashRange) (err error) {
-	n.Engine.Stream(func(key, value string) error {
-		if CheckIfHashInHashRange(key, hashRange) {
-			n.RequestRepair(key, value, otherNode)
+	mt := n.Engine.GetMerkleTree(hashRange)
+	var leaves []int
+	paths := []string{""}
+	for len(paths) > 0 {
+		remote, err := n.RequestMerkleHashes(hashRange, paths, otherNode)
+		if err != nil {
+			return err
 		}
+		var next []string
+		for _, path := range paths {
+			mtn := mt.GetNode(path)
+			if string(remote[path]) == mtn.Hash {
+				continue
+			}
+			if mtn.IsLeaf {
+				leaf, err := strconv.ParseInt("0"+path, 2, 64)
+				if err != nil {
+					return err
+				}
+				leaves = append(leaves, int(leaf))
+			} else {
+				next = append(next, path+"0", path+"1")
+			}
+		}
+		paths = next
+	}
+	if len(leaves) == 0 {
+		log.Infof("Range already in sync with node=%s", otherNode)
 		return nil
+	}
+
+	log.Infof("Repairing %d of %d leaves with node=%s", len(leaves), len(mt.LeafNodes), otherNode)
+	horizon := n.tombstoneHorizon(hashRange, n.GetRepairPeers()[hashRange])
+	// Every key must be acknowledged, tombstone collection counts on the
+	// other node having received them once the repair succeeded
+	err = n.Engine.StreamLeaves(mt, leaves, func(key string, rec *Record) error {
+		// Would only bring back a tombstone the other node already purged
+		if rec.Purgeable(horizon) {
+			return nil
+		}
+		n.limiter.Wait()
+		return n.RepairKey(key, rec, otherNode)
 	})
+	if err != nil {
+		return err
+	}
+	n.RequestMerkleSync(hashRange, leaves, otherNode)
 	return nil
 }
 
 const (
-	ReadTimeout  = 3 * time.Second
-	WriteTimeout = 3 * time.Second
+	ReadTimeout   = 3 * time.Second
+	WriteTimeout  = 3 * time.Second
+	RepairTimeout = 3 * time.Second
 )
 
 /*
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNetwork connects fakeMemberships in process, messages are delivered
+// directly to the delegate of the receiving node
+type fakeNetwork struct {
+	members map[string]*fakeMembership
+	mu      sync.Mutex
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{members: make(map[string]*fakeMembership)}
+}
+
+// fakeMembership is a Membership on a fakeNetwork, every member is alive
+// until it is marked down
+type fakeMembership struct {
+	network  *fakeNetwork
+	node     *NodeInfo
+	delegate *MemberListDelegate
+	events   *MemberListEvents
+	down     bool
+}
+
+func (net *fakeNetwork) create(node *NodeInfo, delegate *MemberListDelegate, events *MemberListEvents) Membership {
+	m := &fakeMembership{network: net, node: node, delegate: delegate, events: events}
+	net.mu.Lock()
+	net.members[node.Name] = m
+	net.mu.Unlock()
+	return m
+}
+
+// get returns the member named name, which may be padded
+func (net *fakeNetwork) get(name string) *fakeMembership {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	for _, m := range net.members {
+		if m.node.Name == name || PadName(m.node.Name) == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (net *fakeNetwork) others(name string) []*fakeMembership {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	var others []*fakeMembership
+	for _, m := range net.members {
+		if m.node.Name != name {
+			others = append(others, m)
+		}
+	}
+	return others
+}
+
+// setDown marks the named node down and reports it as left to the others
+func (net *fakeNetwork) setDown(name string) {
+	net.get(name).down = true
+	for _, m := range net.others(name) {
+		m.events.OnLeave(name)
+	}
+}
+
+func (m *fakeMembership) Join(seedNode *NodeInfo) error {
+	seed := m.network.get(seedNode.Name)
+	if seed == nil || seed.down {
+		return errors.New("seed is not reachable")
+	}
+	m.delegate.MergeState(seed.delegate.GetState())
+	seed.delegate.MergeState(m.delegate.GetState())
+	return nil
+}
+
+func (m *fakeMembership) Leave() error {
+	m.network.setDown(m.node.Name)
+	return nil
+}
+
+func (m *fakeMembership) SendTCP(msg []byte, name string) error {
+	target := m.network.get(name)
+	if target == nil || target.down || m.down {
+		return errors.New("node is not reachable")
+	}
+	go target.delegate.ProcessMsg(msg)
+	return nil
+}
+
+func (m *fakeMembership) SendUDP(msg []byte, name string) error {
+	return m.SendTCP(msg, name)
+}
+
+func (m *fakeMembership) Broadcast(name string, msg []byte) {
+	for _, other := range m.network.others(m.node.Name) {
+		m.SendTCP(msg, other.node.Name)
+	}
+}
+
+func (m *fakeMembership) UpdateNode() error {
+	return nil
+}
+
+func (m *fakeMembership) Meta() map[string][]byte {
+	meta := make(map[string][]byte)
+	for _, other := range m.network.others(m.node.Name) {
+		if !other.down {
+			meta[other.node.Name] = other.delegate.GetMeta(512)
+		}
+	}
+	return meta
+}
+
+func (m *fakeMembership) Members() []Member {
+	members := []Member{{Name: m.node.Name, State: ALIVE}}
+	for _, other := range m.network.others(m.node.Name) {
+		if !other.down {
+			members = append(members, Member{Name: other.node.Name, State: ALIVE})
+		}
+	}
+	return members
+}
+
+func (m *fakeMembership) CheckIfNodeAlive(node *NodeInfo) bool {
+	target := m.network.get(node.Name)
+	return target != nil && !target.down
+}
+
+func (m *fakeMembership) WaitForNode(name string, timeout time.Duration) bool {
+	target := m.network.get(name)
+	return target != nil && !target.down
+}
+
+// startFakeCluster starts count nodes with the same config on a fakeNetwork
+func startFakeCluster(t *testing.T, count int) (*fakeNetwork, []*Node) {
+	t.Helper()
+	net := newFakeNetwork()
+	local := DefaultLocalConfig()
+	local.Storage = MEMORY
+	var nodes []*Node
+	for i := 0; i < count; i++ {
+		// Every node gets its own copy of the config, as if it was started separately
+		var infos []*NodeInfo
+		for j := 0; j < count; j++ {
+			port := strconv.Itoa(7001 + j)
+			infos = append(infos, &NodeInfo{Name: "n" + port, Addr: "127.0.0.1", Port: port, APIPort: strconv.Itoa(8001 + j)})
+		}
+		cfg := CreateConfig(THREE, QUORUM, infos)
+		nodes = append(nodes, startNode(cfg, infos[i], nil, local, func(delegate *MemberListDelegate, events *MemberListEvents) Membership {
+			return net.create(infos[i], delegate, events)
+		}))
+	}
+	return net, nodes
+}
+
+func TestNodeReadWrite(t *testing.T) {
+	_, nodes := startFakeCluster(t, 3)
+
+	err := nodes[0].Write("key", "value", WriteOptions{})
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	result, err := nodes[1].Read("key")
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if len(result.Values) != 1 || result.Values[0] != "value" {
+		t.Fatalf("read %v, want [value]", result.Values)
+	}
+
+	err = nodes[2].Delete("key", WriteOptions{})
+	if err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+	_, err = nodes[0].Read("key")
+	if err == nil || err.Error() != KEY_NOT_FOUND {
+		t.Fatalf("read after delete returned %v, want %s", err, KEY_NOT_FOUND)
+	}
+}
+
+func TestNodeReadWriteWithNodeDown(t *testing.T) {
+	net, nodes := startFakeCluster(t, 3)
+	net.setDown(nodes[2].Info.Name)
+
+	err := nodes[0].Write("key", "value", WriteOptions{})
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	result, err := nodes[1].Read("key")
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if len(result.Values) != 1 || result.Values[0] != "value" {
+		t.Fatalf("read %v, want [value]", result.Values)
+	}
+}
+
+// slowStorage delays every Get, widening the window between reading and
+// writing a key
+type slowStorage struct {
+	*MemoryStorage
+}
+
+func (s slowStorage) Get(key []byte) ([]byte, error) {
+	time.Sleep(2 * time.Millisecond)
+	return s.MemoryStorage.Get(key)
+}
+
+func TestApplyRecordConcurrent(t *testing.T) {
+	n := &Node{
+		Config: CreateConfig(ONE, QUORUM, []*NodeInfo{{Name: "n7001"}}),
+		Engine: CreateEngine(slowStorage{NewMemoryStorage()}),
+	}
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		older := &Record{Timestamp: Timestamp{WallTime: 1, NodeID: PadName("n7001")}, Value: []byte("older")}
+		newer := &Record{Timestamp: Timestamp{WallTime: 2, NodeID: PadName("n7001")}, Value: []byte("newer")}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			n.applyRecord(key, newer)
+		}()
+		go func() {
+			defer wg.Done()
+			// Reads before the newer record is stored, writes after it
+			time.Sleep(1 * time.Millisecond)
+			n.applyRecord(key, older)
+		}()
+		wg.Wait()
+		rec, err := n.Engine.Read(key)
+		if err != nil {
+			t.Fatalf("read failed: %s", err)
+		}
+		if string(rec.Value) != "newer" {
+			t.Fatalf("stored %q, want the newer record", rec.Value)
+		}
+	}
+}
+
+func TestNodeRejectsInternalKeys(t *testing.T) {
+	_, nodes := startFakeCluster(t, 3)
+	key := merkleKeyPrefix + "key"
+
+	if err := nodes[0].Write(key, "value", WriteOptions{}); err == nil || err.Error() != INVALID_KEY {
+		t.Fatalf("write returned %v, want %s", err, INVALID_KEY)
+	}
+	if err := nodes[0].Delete(key, WriteOptions{}); err == nil || err.Error() != INVALID_KEY {
+		t.Fatalf("delete returned %v, want %s", err, INVALID_KEY)
+	}
+	if _, err := nodes[0].Read(key); err == nil || err.Error() != INVALID_KEY {
+		t.Fatalf("read returned %v, want %s", err, INVALID_KEY)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+// Quorum counts replica responses until the consistency level is satisfied.
+// Only responses of the replicas it was created for count, writes sent to
+// pending replicas of a joining node are not part of the quorum.
+type Quorum struct {
+	required int
+	counted  map[string]bool // padded names of replicas whose responses count
+	got      int
+}
+
+// NewQuorum returns the quorum for a request sent to replicas, where
+// minRequired is the number of responses QUORUM and ALL need. LOCAL_QUORUM
+// only counts replicas in the coordinator's zone and needs a majority of
+// them, it falls back to QUORUM when no replica is in that zone.
+func (n *Node) NewQuorum(replicas []*NodeInfo, minRequired int) *Quorum {
+	all := make(map[string]bool)
+	for _, node := range replicas {
+		all[PadName(node.Name)] = true
+	}
+	if n.Config.ConsistencyLevel != LOCAL_QUORUM {
+		return &Quorum{required: minRequired, counted: all}
+	}
+	zone := n.LocalZone()
+	local := make(map[string]bool)
+	for _, node := range replicas {
+		if node.Zone == zone {
+			local[PadName(node.Name)] = true
+		}
+	}
+	if len(local) == 0 {
+		return &Quorum{required: len(replicas)/2 + 1, counted: all}
+	}
+	return &Quorum{required: len(local)/2 + 1, counted: local}
+}
+
+// Add records a response and reports whether the quorum is reached
+func (q *Quorum) Add(from string) bool {
+	if q.counted[PadName(from)] {
+		q.got++
+	}
+	return q.Reached()
+}
+
+// Possible reports whether responses of the given replicas can reach the quorum
+func (q *Quorum) Possible(replicas []*NodeInfo) bool {
+	counted := 0
+	for _, node := range replicas {
+		if q.counted[PadName(node.Name)] {
+			counted++
+		}
+	}
+	return q.got+counted >= q.required
+}
+
+func (q *Quorum) Reached() bool {
+	return q.got >= q.required
+}
+
+// LocalZone returns the zone of this node as recorded in the cluster config
+func (n *Node) LocalZone() string {
+	if ni := n.Config.GetNode(n.Info.Name); ni != nil {
+		return ni.Zone
+	}
+	return n.Info.Zone
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ReadRepairMode string
+
+const (
+	NO_READ_REPAIR    ReadRepairMode = "NONE"  // Stale replicas are left to anti-entropy
+	ASYNC_READ_REPAIR ReadRepairMode = "ASYNC" // Stale replicas are repaired after the read returns
+	SYNC_READ_REPAIR  ReadRepairMode = "SYNC"  // The read returns once stale replicas acknowledged the repair
+)
+
+// readState tracks the replica responses of a single read
+type readState struct {
+	key       string
+	replicas  int
+	received  int
+	responses map[string]*Record // decoded record by replica, nil if the replica has none
+	latest    *Record
+}
+
+func (n *Node) collectRead(reads *readState, resp *Response) {
+	reads.received++
+	rec, err := DecodeRecord(resp.Msg)
+	if err != nil {
+		log.Warnf("Ignoring unreadable record for key=%s from %s: %s", reads.key, resp.From, err)
+		return
+	}
+	reads.responses[resp.From] = rec
+	reads.latest = n.reconcile(reads.key, reads.latest, rec)
+}
+
+// readRepair optionally waits for the replicas that did not answer before
+// quorum, then sends the reconciled record to every replica that is missing
+// part of it through the repair path
+func (n *Node) readRepair(reqID string, respChan chan *Response, reads *readState) {
+	if n.Config.ReadRepairWaitAll {
+		timeout := time.After(ReadRepairTimeout)
+	wait:
+		for reads.received < reads.replicas {
+			select {
+			case resp := <-respChan:
+				n.collectRead(reads, resp)
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	n.unregisterRequest(reqID)
+	if reads.latest == nil {
+		return
+	}
+
+	var stale []string
+	for replica, rec := range reads.responses {
+		if !bytes.Equal(EncodeRecord(n.reconcile(reads.key, rec, reads.latest)), EncodeRecord(rec)) {
+			stale = append(stale, replica)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	log.Infof("Read repair of key=%s on %d replicas", reads.key, len(stale))
+
+	if n.Config.ReadRepair != SYNC_READ_REPAIR {
+		for _, replica := range stale {
+			n.RequestRepair("", reads.key, reads.latest, replica)
+		}
+		return
+	}
+	ackID, ackChan := n.registerRequest(len(stale))
+	defer n.unregisterRequest(ackID)
+	for _, replica := range stale {
+		n.RequestRepair(ackID, reads.key, reads.latest, replica)
+	}
+	timeout := time.After(ReadRepairTimeout)
+	for acked := 0; acked < len(stale); acked++ {
+		select {
+		case <-ackChan:
+		case <-timeout:
+			log.Warnf("Read repair of key=%s acknowledged by %d of %d replicas", reads.key, acked, len(stale))
+			return
+		}
+	}
+}
+
+const (
+	ReadRepairTimeout = 1 * time.Second
+)
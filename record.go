@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strconv"
+)
+
+// Record is the envelope stored by the Engine for every key
+type Record struct {
+	Timestamp Timestamp
+	Tombstone bool
+	ExpiresAt int64  // unix milliseconds, 0 if the record never expires
+	Origin    string // node that coordinated the write
+	Value     []byte
+	VClock    VectorClock // causal context of the write, only set for keys in vector clock keyspaces
+	Siblings  []*Record   // concurrent versions, see MergeSiblings
+}
+
+func (r *Record) Expired(now int64) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= now
+}
+
+// Live reports whether the record holds a value a client should see
+func (r *Record) Live() bool {
+	if r == nil {
+		return false
+	}
+	if len(r.Siblings) > 0 {
+		for _, s := range r.Siblings {
+			if s.Live() {
+				return true
+			}
+		}
+		return false
+	}
+	return !r.Tombstone && !r.Expired(physicalTime())
+}
+
+// Purgeable reports whether the record only holds deletes made before the
+// given wall time in milliseconds. A vector clock record is purgeable only
+// if all its siblings are.
+func (r *Record) Purgeable(before int64) bool {
+	if len(r.Siblings) > 0 {
+		for _, s := range r.Siblings {
+			if !s.Purgeable(before) {
+				return false
+			}
+		}
+		return true
+	}
+	return r.Tombstone && r.Timestamp.WallTime < before
+}
+
+// NewerRecord returns whichever record has the later timestamp, nil counts as oldest
+func NewerRecord(a, b *Record) *Record {
+	if a == nil {
+		return b
+	}
+	if b == nil || !a.Timestamp.Less(b.Timestamp) {
+		return a
+	}
+	return b
+}
+
+/*
+Record layout (version 2), integers are big endian:
+	magic (1) | version (1) | flags (1)
+	wall time (8) | logical (4) | node ID length (1) | node ID
+	expires at (8)
+	origin length (1) | origin
+	value length (4) | value
+	vector clock entries (2) | per entry: node length (1) | node | counter (8)
+	sibling count (2) | per sibling: length (4) | encoded record
+	CRC32 of everything before it (4)
+Version 1 records end after the value.
+*/
+
+func EncodeRecord(r *Record) []byte {
+	if r == nil {
+		return nil
+	}
+	b := make([]byte, 0, recordFixedLen+len(r.Timestamp.NodeID)+len(r.Origin)+len(r.Value))
+	var flags byte
+	if r.Tombstone {
+		flags |= recordFlagTombstone
+	}
+	b = append(b, RecordMagic, RecordVersion, flags)
+	b = appendUint64(b, uint64(r.Timestamp.WallTime))
+	b = appendUint32(b, r.Timestamp.Logical)
+	b = append(b, byte(len(r.Timestamp.NodeID)))
+	b = append(b, r.Timestamp.NodeID...)
+	b = appendUint64(b, uint64(r.ExpiresAt))
+	b = append(b, byte(len(r.Origin)))
+	b = append(b, r.Origin...)
+	b = appendUint32(b, uint32(len(r.Value)))
+	b = append(b, r.Value...)
+	b = appendVectorClock(b, r.VClock)
+	b = append(b, byte(len(r.Siblings)>>8), byte(len(r.Siblings)))
+	for _, s := range r.Siblings {
+		sb := EncodeRecord(s)
+		b = appendUint32(b, uint32(len(sb)))
+		b = append(b, sb...)
+	}
+	b = appendUint32(b, crc32.ChecksumIEEE(b))
+	return b
+}
+
+// DecodeRecord decodes a stored record, an empty input decodes to nil.
+// Values written before the envelope existed are converted on the fly.
+func DecodeRecord(b []byte) (*Record, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if b[0] != RecordMagic {
+		return decodeLegacyRecord(string(b))
+	}
+	if len(b) < recordFixedLen {
+		return nil, errors.New(INVALID_RECORD)
+	}
+	if b[1] != RecordVersion && b[1] != recordVersionNoClock {
+		return nil, errors.New(UNSUPPORTED_RECORD_VERSION)
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.New(CORRUPT_RECORD)
+	}
+
+	d := recordDecoder{b: body[3:]}
+	r := &Record{Tombstone: body[2]&recordFlagTombstone != 0}
+	r.Timestamp.WallTime = int64(d.uint64())
+	r.Timestamp.Logical = d.uint32()
+	r.Timestamp.NodeID = string(d.bytes(int(d.byte())))
+	r.ExpiresAt = int64(d.uint64())
+	r.Origin = string(d.bytes(int(d.byte())))
+	r.Value = d.bytes(int(d.uint32()))
+	if b[1] >= RecordVersion {
+		r.VClock = d.vectorClock()
+		count := int(d.byte())<<8 | int(d.byte())
+		for i := 0; i < count && d.err == nil; i++ {
+			s, err := DecodeRecord(d.bytes(int(d.uint32())))
+			if err != nil {
+				return nil, err
+			}
+			r.Siblings = append(r.Siblings, s)
+		}
+	}
+	if d.err != nil || len(d.b) != 0 {
+		return nil, errors.New(INVALID_RECORD)
+	}
+	return r, nil
+}
+
+// decodeLegacyRecord handles values stored as a timestamp prefix followed by
+// the value text, either an HLC prefix or 10 digit Unix seconds
+func decodeLegacyRecord(value string) (*Record, error) {
+	var r Record
+	if len(value) >= TimestampLen {
+		if ts, err := DecodeTimestamp(value[:TimestampLen]); err == nil {
+			r.Timestamp = ts
+			value = value[TimestampLen:]
+			r.Tombstone = value == DeletedHash
+			if !r.Tombstone {
+				r.Value = []byte(value)
+			}
+			return &r, nil
+		}
+	}
+	if len(value) < 10 {
+		return nil, errors.New(INVALID_RECORD)
+	}
+	secs, err := strconv.ParseInt(value[:10], 10, 64)
+	if err != nil {
+		return nil, errors.New(INVALID_RECORD)
+	}
+	r.Timestamp.WallTime = secs * 1000
+	value = value[10:]
+	r.Tombstone = value == DeletedHash
+	if !r.Tombstone {
+		r.Value = []byte(value)
+	}
+	return &r, nil
+}
+
+// IsLegacyRecord reports whether b was stored before the current record version
+func IsLegacyRecord(b []byte) bool {
+	return len(b) > 1 && (b[0] != RecordMagic || b[1] != RecordVersion)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// recordDecoder reads fields sequentially and remembers the first short read
+type recordDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *recordDecoder) bytes(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errors.New(INVALID_RECORD)
+		return nil
+	}
+	v := make([]byte, n)
+	copy(v, d.b[:n])
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *recordDecoder) byte() byte {
+	v := d.bytes(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+func (d *recordDecoder) uint32() uint32 {
+	v := d.bytes(4)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (d *recordDecoder) uint64() uint64 {
+	v := d.bytes(8)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+const (
+	RecordMagic   byte = 0xb5
+	RecordVersion byte = 2
+
+	recordVersionNoClock byte = 1
+
+	recordFlagTombstone byte = 1 << 0
+	// magic, version, flags, wall, logical, node ID length, expiry, origin length, value length, checksum
+	recordFixedLen = 3 + 8 + 4 + 1 + 8 + 1 + 4 + 4
+)
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecordEncoding(t *testing.T) {
+	ts := Timestamp{WallTime: 1700000000000, Logical: 3, NodeID: PadName("n7001")}
+	tests := []struct {
+		name string
+		rec  *Record
+	}{
+		{"value", &Record{Timestamp: ts, Origin: "n7001", Value: []byte("value")}},
+		{"empty value", &Record{Timestamp: ts, Origin: "n7001", Value: []byte{}}},
+		{"tombstone", &Record{Timestamp: ts, Origin: "n7001", Tombstone: true, Value: []byte{}}},
+		{"expiring", &Record{Timestamp: ts, Origin: "n7001", ExpiresAt: 1700000060000, Value: []byte("value")}},
+		{"vector clock", &Record{Timestamp: ts, Origin: "n7001", Value: []byte("value"), VClock: VectorClock{"n7001": 5, "n7002": 9}}},
+		{"siblings", &Record{Timestamp: ts, Value: []byte{}, VClock: VectorClock{"n7001": 5}, Siblings: []*Record{
+			{Timestamp: ts, Origin: "n7001", Value: []byte("a")},
+			{Timestamp: ts, Origin: "n7002", Value: []byte("b")},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := DecodeRecord(EncodeRecord(tt.rec))
+			if err != nil {
+				t.Fatalf("decoding failed: %s", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.rec) {
+				t.Fatalf("decoded %+v, want %+v", decoded, tt.rec)
+			}
+		})
+	}
+}
+
+func TestDecodeRecordRejectsDamage(t *testing.T) {
+	valid := EncodeRecord(&Record{
+		Timestamp: Timestamp{WallTime: 1700000000000, NodeID: PadName("n7001")},
+		Origin:    "n7001",
+		Value:     []byte("value"),
+	})
+	damage := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"flipped value bit", damage(func(b []byte) []byte { b[len(b)-6] ^= 1; return b }), CORRUPT_RECORD},
+		{"flipped checksum bit", damage(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }), CORRUPT_RECORD},
+		{"truncated", damage(func(b []byte) []byte { return b[:len(b)-1] }), CORRUPT_RECORD},
+		{"too short", valid[:5], INVALID_RECORD},
+		{"unknown version", damage(func(b []byte) []byte { b[1] = RecordVersion + 1; return b }), UNSUPPORTED_RECORD_VERSION},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeRecord(tt.b)
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("decoding returned %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeLegacyRecord(t *testing.T) {
+	ts := Timestamp{WallTime: 1700000000000, Logical: 1, NodeID: PadName("n7001")}
+	tests := []struct {
+		name  string
+		value string
+		want  *Record
+	}{
+		{"clock prefix", ts.Encode() + "value", &Record{Timestamp: ts, Value: []byte("value")}},
+		{"clock prefix delete", ts.Encode() + DeletedHash, &Record{Timestamp: ts, Tombstone: true}},
+		{"seconds prefix", "1700000000value", &Record{Timestamp: Timestamp{WallTime: 1700000000000}, Value: []byte("value")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := DecodeRecord([]byte(tt.value))
+			if err != nil {
+				t.Fatalf("decoding failed: %s", err)
+			}
+			if !reflect.DeepEqual(rec, tt.want) {
+				t.Fatalf("decoded %+v, want %+v", rec, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RepairScheduler periodically runs anti-entropy for every range this node
+// replicates, each time against the replica that was repaired least recently
+type RepairScheduler struct {
+	node   *Node
+	sem    chan struct{} // bounds the number of ranges repaired at once, see SetConcurrency
+	status map[HashRange]*RangeRepairStatus
+	stop   chan struct{}
+	wg     sync.WaitGroup // the scheduling loop and repairs started by RepairNow
+	mu     sync.Mutex
+}
+
+// RangeRepairStatus is the repair progress of one range
+type RangeRepairStatus struct {
+	Range        string               `json:"range"`
+	Running      bool                 `json:"running"`
+	LastPeer     string               `json:"last_peer"`
+	LastRepaired time.Time            `json:"last_repaired"` // end of the last successful repair
+	LastError    string               `json:"last_error,omitempty"`
+	Failures     int                  `json:"failures,omitempty"` // repairs failed in a row
+	RetryAt      time.Time            `json:"retry_at,omitempty"` // a failed repair is not retried before
+	Peers        map[string]time.Time `json:"peers"`              // start of the last successful repair with each peer
+	started      time.Time
+}
+
+func CreateRepairScheduler(n *Node) *RepairScheduler {
+	return &RepairScheduler{
+		node:   n,
+		sem:    make(chan struct{}, n.Config.RepairConcurrency),
+		status: make(map[HashRange]*RangeRepairStatus),
+		stop:   make(chan struct{}),
+	}
+}
+
+func (rs *RepairScheduler) Start() {
+	log.Infof("Starting repair scheduler with interval %s", rs.node.Config.RepairInterval)
+	rs.wg.Add(1)
+	go rs.run()
+}
+
+// Stop stops scheduling repairs and waits for the running ones
+func (rs *RepairScheduler) Stop() {
+	close(rs.stop)
+	rs.wg.Wait()
+}
+
+func (rs *RepairScheduler) run() {
+	defer rs.wg.Done()
+	ticker := time.NewTicker(RepairCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rs.repairDueRanges()
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// repairDueRanges repairs every range not repaired within the repair interval
+func (rs *RepairScheduler) repairDueRanges() {
+	var wg sync.WaitGroup
+	for hr, peers := range rs.node.GetRepairPeers() {
+		peer, due := rs.nextRepair(hr, peers)
+		if !due {
+			continue
+		}
+		sem := rs.semaphore()
+		select {
+		case sem <- struct{}{}:
+		case <-rs.stop:
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(hr HashRange, peer string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			log.Infof("Scheduled repair of range %s with node=%s", merkleRangeID(hr), peer)
+			err := rs.node.RepairHashRange(peer, hr)
+			rs.finishRepair(hr, peer, err)
+		}(hr, peer)
+	}
+	wg.Wait()
+}
+
+// nextRepair marks the range as running and picks the peer repaired least
+// recently, if the range is due for repair
+func (rs *RepairScheduler) nextRepair(hr HashRange, peers []string) (string, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	status := rs.statusOf(hr)
+	if status.Running || len(peers) == 0 || time.Now().Before(status.RetryAt) {
+		return "", false
+	}
+	if status.Failures == 0 && time.Since(status.LastRepaired) < rs.node.Config.RepairInterval {
+		return "", false
+	}
+	peer := peers[0]
+	for _, p := range peers[1:] {
+		if status.Peers[p].Before(status.Peers[peer]) {
+			peer = p
+		}
+	}
+	status.Running = true
+	status.started = time.Now()
+	return peer, true
+}
+
+// RepairNow repairs every range shared with peer in the background, skipping
+// ranges whose repair is already running
+func (rs *RepairScheduler) RepairNow(peer string) {
+	var ranges []HashRange
+	for hr, peers := range rs.node.GetRepairPeers() {
+		for _, p := range peers {
+			if p == peer {
+				ranges = append(ranges, hr)
+			}
+		}
+	}
+	log.Infof("Repairing %d ranges with node=%s", len(ranges), peer)
+	for _, hr := range ranges {
+		rs.wg.Add(1)
+		go func(hr HashRange) {
+			defer rs.wg.Done()
+			rs.mu.Lock()
+			status := rs.statusOf(hr)
+			if status.Running {
+				rs.mu.Unlock()
+				return
+			}
+			status.Running = true
+			status.started = time.Now()
+			rs.mu.Unlock()
+			sem := rs.semaphore()
+			select {
+			case sem <- struct{}{}:
+			case <-rs.stop:
+				rs.finishRepair(hr, peer, errors.New(REPAIR_STOPPED))
+				return
+			}
+			defer func() { <-sem }()
+			err := rs.node.RepairHashRange(peer, hr)
+			rs.finishRepair(hr, peer, err)
+		}(hr)
+	}
+}
+
+// SetConcurrency changes the number of ranges repaired at once. Running
+// repairs release the semaphore they acquired, so the new limit applies to
+// repairs starting from now on.
+func (rs *RepairScheduler) SetConcurrency(concurrency int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if cap(rs.sem) != concurrency {
+		rs.sem = make(chan struct{}, concurrency)
+	}
+}
+
+func (rs *RepairScheduler) semaphore() chan struct{} {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.sem
+}
+
+// statusOf returns the status of a range, creating it if needed. The caller
+// must hold rs.mu.
+func (rs *RepairScheduler) statusOf(hr HashRange) *RangeRepairStatus {
+	status, ok := rs.status[hr]
+	if !ok {
+		status = &RangeRepairStatus{Range: merkleRangeID(hr), Peers: make(map[string]time.Time)}
+		rs.status[hr] = status
+	}
+	return status
+}
+
+func (rs *RepairScheduler) finishRepair(hr HashRange, peer string, err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	status := rs.status[hr]
+	status.Running = false
+	status.LastPeer = peer
+	if err != nil {
+		log.Warnf("Repair of range %s with node=%s failed: %s", status.Range, peer, err)
+		status.LastError = err.Error()
+		status.Failures++
+		status.RetryAt = time.Now().Add(repairBackoff(status.Failures, rs.node.Config.RepairInterval))
+		return
+	}
+	status.LastRepaired = time.Now()
+	status.LastError = ""
+	status.Failures = 0
+	status.RetryAt = time.Time{}
+	// Everything written before the start was exchanged
+	status.Peers[peer] = status.started
+}
+
+// repairBackoff is how long to wait before retrying a range whose repair
+// failed the given number of times in a row, doubling up to the repair interval
+func repairBackoff(failures int, interval time.Duration) time.Duration {
+	backoff := RepairRetryInterval
+	for i := 1; i < failures && backoff < interval; i++ {
+		backoff *= 2
+	}
+	if backoff > interval {
+		backoff = interval
+	}
+	return backoff
+}
+
+// LastRepairs returns when the last successful repair of hr with each peer started
+func (rs *RepairScheduler) LastRepairs(hr HashRange) map[string]time.Time {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	peers := make(map[string]time.Time)
+	for peer, t := range rs.statusOf(hr).Peers {
+		peers[peer] = t
+	}
+	return peers
+}
+
+// Status returns a snapshot of the repair progress of every range
+func (rs *RepairScheduler) Status() []RangeRepairStatus {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	statuses := make([]RangeRepairStatus, 0, len(rs.status))
+	for _, status := range rs.status {
+		s := *status
+		s.Peers = make(map[string]time.Time, len(status.Peers))
+		for peer, t := range status.Peers {
+			s.Peers[peer] = t
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// GetRepairPeers returns the other replicas of every range this node replicates
+func (n *Node) GetRepairPeers() map[HashRange][]string {
+	peers := make(map[HashRange][]string)
+	for _, node := range n.Config.Nodes {
+		if node.Name == n.Info.Name {
+			continue
+		}
+		for _, hr := range n.Router.GetHashRangesForRepair(n.Info.Name, node.Name) {
+			peers[hr] = append(peers[hr], node.Name)
+		}
+	}
+	return peers
+}
+
+// RateLimiter spaces out events to at most a fixed number per second
+type RateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	mu       sync.Mutex
+}
+
+// NewRateLimiter returns a limiter allowing perSecond events, 0 means no limit
+func NewRateLimiter(perSecond int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(perSecond)
+	return l
+}
+
+// SetRate changes the limit to perSecond events, 0 means no limit
+func (l *RateLimiter) SetRate(perSecond int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = 0
+	if perSecond > 0 {
+		l.interval = time.Second / time.Duration(perSecond)
+	}
+}
+
+// Wait blocks until the next event is allowed
+func (l *RateLimiter) Wait() {
+	l.mu.Lock()
+	if l.interval == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+const (
+	DefaultRepairInterval      = 1 * time.Hour
+	DefaultRepairConcurrency   = 2
+	DefaultRepairKeysPerSecond = 1000
+	RepairCheckInterval        = 1 * time.Minute
+	RepairRetryInterval        = 5 * time.Minute // first retry of a failed repair, doubled on every failure
+)
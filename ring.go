@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+)
+
+// TokenRing is an immutable snapshot of the vnodes of a config sorted by
+// token. A new ring is built whenever the membership changes instead of
+// modifying one that lookups may be using. Its nodes are copies, so the
+// config it was built from is left untouched.
+type TokenRing struct {
+	vnodes            []vnode // sorted by token
+	nodes             []*NodeInfo
+	zones             int // number of distinct zones of the nodes
+	replicationFactor int
+	placement         PlacementStrategy
+	next              *TokenRing // ring including pending nodes, nil if there are none
+}
+
+// vnode is a single token of a node on the ring. It owns the keys hashing
+// between the previous token (exclusive) and its own token.
+type vnode struct {
+	Token string
+	Node  *NodeInfo
+}
+
+// NewTokenRing builds the ring of the nodes of cfg owning data. While nodes
+// are joining, leaving or changing their weight, the ring formed once they
+// are done is built as well, without the nodes being replaced.
+func NewTokenRing(cfg *Config) *TokenRing {
+	nodes := make([]*NodeInfo, len(cfg.Nodes))
+	for i, node := range cfg.Nodes {
+		nodes[i] = node.Copy()
+		// Tokens are missing from configs sent by older versions
+		nodes[i].AssignTokens(node.TokenCount(cfg.VNodes))
+	}
+	tr := buildTokenRing(cfg, nodes, func(node *NodeInfo) bool { return node.IsOwner() })
+	replaced := make(map[string]bool)
+	changing := false
+	next := make([]*NodeInfo, len(nodes))
+	for i, node := range nodes {
+		if node.Status == JOINING && node.Replaces != "" {
+			replaced[node.Replaces] = true
+		}
+		changing = changing || node.Status == JOINING || node.Status == LEAVING || node.NewWeight != 0
+		next[i] = node
+		if node.NewWeight != 0 {
+			next[i] = node.Copy()
+			next[i].Weight, next[i].NewWeight = node.NewWeight, 0
+			next[i].AssignTokens(next[i].TokenCount(cfg.VNodes))
+		}
+	}
+	if changing {
+		tr.next = buildTokenRing(cfg, next, func(node *NodeInfo) bool {
+			return node.Status != LEAVING && !replaced[node.Name]
+		})
+	}
+	return tr
+}
+
+func buildTokenRing(cfg *Config, nodes []*NodeInfo, include func(node *NodeInfo) bool) *TokenRing {
+	tr := &TokenRing{
+		replicationFactor: int(cfg.ReplicationFactor),
+		placement:         cfg.Placement,
+	}
+	zones := make(map[string]bool)
+	for _, node := range nodes {
+		if !include(node) {
+			continue
+		}
+		tr.nodes = append(tr.nodes, node)
+		zones[node.Zone] = true
+		for _, token := range node.Tokens {
+			tr.vnodes = append(tr.vnodes, vnode{Token: token, Node: node})
+		}
+	}
+	sort.Slice(tr.vnodes, func(i, j int) bool {
+		if tr.vnodes[i].Token == tr.vnodes[j].Token {
+			// Colliding tokens are ordered by name so every node builds the same ring
+			return tr.vnodes[i].Node.Name < tr.vnodes[j].Node.Name
+		}
+		return tr.vnodes[i].Token < tr.vnodes[j].Token
+	})
+	tr.zones = len(zones)
+	return tr
+}
+
+// Next returns the ring after pending membership changes complete
+func (tr *TokenRing) Next() *TokenRing {
+	if tr.next == nil {
+		return tr
+	}
+	return tr.next
+}
+
+func (tr *TokenRing) Len() int {
+	return len(tr.vnodes)
+}
+
+// Find returns the index of the vnode owning hash, the first vnode whose
+// token is not smaller than hash, wrapping around past the last token
+func (tr *TokenRing) Find(hash string) int {
+	idx := sort.Search(len(tr.vnodes), func(i int) bool {
+		return tr.vnodes[i].Token >= hash
+	})
+	if idx == len(tr.vnodes) {
+		return 0
+	}
+	return idx
+}
+
+// Range returns the range of hashes owned by the vnode at idx
+func (tr *TokenRing) Range(idx int) HashRange {
+	prev := tr.vnodes[(idx-1+len(tr.vnodes))%len(tr.vnodes)]
+	return HashRange{Low: prev.Token, High: tr.vnodes[idx].Token}
+}
+
+// Walk returns up to count distinct nodes starting at the vnode at idx and
+// moving clockwise, skipping further vnodes of nodes already chosen. With
+// zone aware placement a first pass only picks nodes in zones not chosen yet,
+// until every zone has one, and a second pass fills up with the remaining
+// nodes in ring order.
+func (tr *TokenRing) Walk(idx int, count int) []*NodeInfo {
+	if count > len(tr.nodes) {
+		count = len(tr.nodes)
+	}
+	nodes := make([]*NodeInfo, 0, count)
+	seen := make(map[string]bool)
+	if tr.placement == ZONE_AWARE {
+		zones := make(map[string]bool)
+		for i := 0; i < len(tr.vnodes) && len(nodes) < count && len(zones) < tr.zones; i++ {
+			node := tr.vnodes[(idx+i)%len(tr.vnodes)].Node
+			if !seen[node.Name] && !zones[node.Zone] {
+				seen[node.Name] = true
+				zones[node.Zone] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	for i := 0; i < len(tr.vnodes) && len(nodes) < count; i++ {
+		node := tr.vnodes[(idx+i)%len(tr.vnodes)].Node
+		if !seen[node.Name] {
+			seen[node.Name] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// ReplicasOf returns the nodes holding a replica of hash
+func (tr *TokenRing) ReplicasOf(hash string) []*NodeInfo {
+	if tr.Len() == 0 {
+		return nil
+	}
+	return tr.Replicas(tr.Find(hash))
+}
+
+// Replicas returns the nodes holding a replica of the vnode at idx
+func (tr *TokenRing) Replicas(idx int) []*NodeInfo {
+	return tr.Walk(idx, tr.replicationFactor)
+}
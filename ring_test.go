@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testConfig returns a config of nodes n7001, n7002, ... in the given zones
+func testConfig(rf ReplicationFactor, zones ...string) *Config {
+	var nodes []*NodeInfo
+	for i, zone := range zones {
+		nodes = append(nodes, &NodeInfo{Name: "n" + strconv.Itoa(7001+i), Zone: zone})
+	}
+	return CreateConfig(rf, QUORUM, nodes)
+}
+
+func TestZoneAwarePlacement(t *testing.T) {
+	tests := []struct {
+		name  string
+		rf    ReplicationFactor
+		zones []string
+		want  int // distinct zones every range is replicated in
+	}{
+		{"one zone per replica", THREE, []string{"a", "a", "b", "b", "c", "c"}, 3},
+		{"fewer zones than replicas", THREE, []string{"a", "a", "a", "b", "b"}, 2},
+		{"more zones than replicas", TWO, []string{"a", "b", "c", "d"}, 2},
+		{"fewer nodes than replicas", THREE, []string{"a", "b"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(tt.rf, tt.zones...)
+			cfg.Placement = ZONE_AWARE
+			ring := NewTokenRing(cfg)
+			replicas := int(tt.rf)
+			if replicas > len(tt.zones) {
+				replicas = len(tt.zones)
+			}
+			for i := 0; i < ring.Len(); i++ {
+				nodes := ring.Replicas(i)
+				names, zones := make(map[string]bool), make(map[string]bool)
+				for _, node := range nodes {
+					names[node.Name] = true
+					zones[node.Zone] = true
+				}
+				if len(nodes) != replicas || len(names) != replicas {
+					t.Fatalf("range %d has replicas %v, want %d distinct nodes", i, names, replicas)
+				}
+				if len(zones) != tt.want {
+					t.Fatalf("range %d is replicated in zones %v, want %d zones", i, zones, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenRingFind(t *testing.T) {
+	ring := NewTokenRing(testConfig(THREE, "", "", ""))
+	first, last := ring.vnodes[0].Token, ring.vnodes[ring.Len()-1].Token
+	tests := []struct {
+		name string
+		hash string
+		want int
+	}{
+		{"before the first token", EmptyHash, 0},
+		{"at the first token", first, 0},
+		{"just after the first token", first + "\x00", 1},
+		{"at the last token", last, ring.Len() - 1},
+		{"after the last token", strings.Repeat("\xff", 32), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ring.Find(tt.hash); got != tt.want {
+				t.Fatalf("found vnode %d, want %d", got, tt.want)
+			}
+		})
+	}
+	for i := 0; i < ring.Len(); i++ {
+		hr := ring.Range(i)
+		if ring.Find(hr.High) != i || (ring.Len() > 1 && ring.Find(hr.Low) == i) {
+			t.Fatalf("range %d does not end at its own token", i)
+		}
+	}
+}
+
+func TestTokenRingWalk(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes int
+		count int
+		want  int
+	}{
+		{"replicas", 5, 3, 3},
+		{"every node", 3, 3, 3},
+		{"more replicas than nodes", 2, 3, 2},
+		{"single node", 1, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewTokenRing(testConfig(THREE, make([]string, tt.nodes)...))
+			for i := 0; i < ring.Len(); i++ {
+				nodes := ring.Walk(i, tt.count)
+				if len(nodes) != tt.want {
+					t.Fatalf("walk from %d returned %d nodes, want %d", i, len(nodes), tt.want)
+				}
+				if nodes[0] != ring.vnodes[i].Node {
+					t.Fatalf("walk from %d does not start at the owner of the vnode", i)
+				}
+				seen := make(map[string]bool)
+				for _, node := range nodes {
+					if seen[node.Name] {
+						t.Fatalf("walk from %d returned %s twice", i, node.Name)
+					}
+					seen[node.Name] = true
+				}
+				// Further nodes follow in ring order
+				j := i
+				for _, node := range nodes[1:] {
+					for ring.vnodes[j].Node != node {
+						if j = (j + 1) % ring.Len(); j == i {
+							t.Fatalf("walk from %d returned %s out of ring order", i, node.Name)
+						}
+					}
+				}
+			}
+		})
+	}
+	if nodes := NewTokenRing(testConfig(THREE)).ReplicasOf(EmptyHash); nodes != nil {
+		t.Fatalf("empty ring returned replicas %v", nodes)
+	}
+}
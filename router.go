@@ -1,81 +1,233 @@
 package main
 
 import (
-	"sort"
+	"errors"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Router is for routing requests to other nodes
+// Router is for routing requests to other nodes. Lookups use the ring that
+// was current when they started, Update swaps in a new one atomically.
 type Router struct {
-	cfg *Config
+	ring   atomic.Value         // *TokenRing
+	meta   map[string]*NodeMeta // advertised metadata by node name
+	metaMu sync.RWMutex
 }
 
 // CreateRouter creates a new router and a virtual ring of nodes
 func CreateRouter(cfg *Config) *Router {
-	r := &Router{cfg: cfg}
-	r.CreateRing()
+	r := &Router{meta: make(map[string]*NodeMeta)}
+	r.Update(cfg)
 	return r
 }
 
-func (r *Router) CreateRing() {
+// Update builds the ring of a new config and replaces the current one
+func (r *Router) Update(cfg *Config) {
 	log.Infof("Creating ring of nodes in the cluster")
-	for _, node := range r.cfg.Nodes {
-		node.GetHash()
-	}
-	nodes := make([]*NodeInfo, len(r.cfg.Nodes))
-	copy(nodes, r.cfg.Nodes)
-	sort.Slice(nodes, func(i, j int) bool {
-		return nodes[i].NodeHash < nodes[j].NodeHash
-	})
-	for i, node := range nodes {
-		node.PrevNodeHash = nodes[(i-1+len(nodes))%len(nodes)].NodeHash
-		node.NextNodeHash = nodes[(i+1)%len(nodes)].NodeHash
-	}
+	r.ring.Store(NewTokenRing(cfg))
+}
+
+func (r *Router) Ring() *TokenRing {
+	return r.ring.Load().(*TokenRing)
+}
+
+func (r *Router) SetNodeMeta(name string, meta *NodeMeta) {
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	r.meta[name] = meta
+}
+
+// GetNodeMeta returns the last metadata advertised by a node, nil if none was seen
+func (r *Router) GetNodeMeta(name string) *NodeMeta {
+	r.metaMu.RLock()
+	defer r.metaMu.RUnlock()
+	return r.meta[name]
 }
 
 func (r *Router) GetNodesInRange(key string, replicationFactor ReplicationFactor) []*NodeInfo {
-	keyHash := GenerateHash(key)
-	nodes := make([]*NodeInfo, 0)
-	ringStartNode := -1
-	// TODO: Make this more efficient
-	for i, nodeInfo := range r.cfg.Nodes {
-		if nodeInfo.CheckIfHashInRange(keyHash) {
-			ringStartNode = i
-			break
+	ring := r.Ring()
+	if ring.Len() == 0 {
+		return nil
+	}
+	return ring.Walk(ring.Find(GenerateHash(key)), int(replicationFactor))
+}
+
+// GetPendingNodesInRange returns the nodes that will become replicas of key
+// once the pending membership changes complete. They receive writes in
+// addition to the current replicas so they don't miss any while streaming.
+func (r *Router) GetPendingNodesInRange(key string) []*NodeInfo {
+	ring := r.Ring()
+	if ring.next == nil {
+		return nil
+	}
+	hash := GenerateHash(key)
+	current := make(map[string]bool)
+	for _, node := range ring.ReplicasOf(hash) {
+		current[node.Name] = true
+	}
+	var pending []*NodeInfo
+	for _, node := range ring.next.ReplicasOf(hash) {
+		if !current[node.Name] {
+			pending = append(pending, node)
 		}
 	}
-	for i := 0; i < int(replicationFactor); i++ {
-		nodes = append(nodes, r.cfg.Nodes[(ringStartNode+i)%len(r.cfg.Nodes)])
+	return pending
+}
+
+// GetSloppyNodesInRange returns the replicas for key with every dead preferred
+// replica replaced by the next alive node further around the ring. standIns
+// maps each stand-in's name to the name of the replica it replaces.
+func (r *Router) GetSloppyNodesInRange(key string, replicationFactor ReplicationFactor, isAlive func(node *NodeInfo) bool) (nodes []*NodeInfo, standIns map[string]string) {
+	ring := r.Ring()
+	if ring.Len() == 0 {
+		return nil, nil
 	}
-	return nodes
+	candidates := ring.Walk(ring.Find(GenerateHash(key)), len(ring.nodes))
+	preferred := int(replicationFactor)
+	if preferred > len(candidates) {
+		preferred = len(candidates)
+	}
+	fallbacks := candidates[preferred:]
+	standIns = make(map[string]string)
+	for _, node := range candidates[:preferred] {
+		if isAlive(node) {
+			nodes = append(nodes, node)
+			continue
+		}
+		for len(fallbacks) > 0 && !isAlive(fallbacks[0]) {
+			fallbacks = fallbacks[1:]
+		}
+		if len(fallbacks) == 0 {
+			// Nobody can stand in, the write is hinted by the coordinator instead
+			nodes = append(nodes, node)
+			continue
+		}
+		nodes = append(nodes, fallbacks[0])
+		standIns[fallbacks[0].Name] = node.Name
+		fallbacks = fallbacks[1:]
+	}
+	return nodes, standIns
+}
+
+// GetHashRangesForNode returns the ranges a node holds a replica of
+func (r *Router) GetHashRangesForNode(node string) []HashRange {
+	return r.GetHashRangesForRepair(node, node)
 }
 
+// GetHashRangesForRepair returns the ranges both nodes hold a replica of
 func (r *Router) GetHashRangesForRepair(currNode, otherNode string) []HashRange {
-	currNodeHash := GenerateHash(currNode)
-	otherNodeHash := GenerateHash(otherNode)
 	hashRanges := make([]HashRange, 0)
-	for i, node := range r.cfg.Nodes {
-		isRangePresent := false
-		for j := i; j < i+int(r.cfg.ReplicationFactor); j++ {
-			if r.cfg.Nodes[j%len(r.cfg.Nodes)].NodeHash == otherNodeHash {
-				isRangePresent = true
+	ring := r.Ring()
+	for i := 0; i < ring.Len(); i++ {
+		isCurrPresent, isOtherPresent := false, false
+		for _, node := range ring.Replicas(i) {
+			isCurrPresent = isCurrPresent || node.Name == currNode
+			isOtherPresent = isOtherPresent || node.Name == otherNode
+		}
+		if isCurrPresent && isOtherPresent {
+			hashRanges = append(hashRanges, ring.Range(i))
+		}
+	}
+	return hashRanges
+}
+
+// GetBootstrapSources returns the ranges node will replicate once it owns its
+// ranges, each with the current replicas it can stream the range from
+func (r *Router) GetBootstrapSources(node string) map[HashRange][]*NodeInfo {
+	sources := make(map[HashRange][]*NodeInfo)
+	ring := r.Ring()
+	next := ring.Next()
+	for i := 0; i < next.Len(); i++ {
+		isPresent := false
+		for _, replica := range next.Replicas(i) {
+			isPresent = isPresent || replica.Name == node
+		}
+		if !isPresent {
+			continue
+		}
+		hr := next.Range(i)
+		// Ranges of the next ring never span a token of the current one
+		current := ring.ReplicasOf(hr.High)
+		for _, replica := range current {
+			if replica.Name == node {
+				// Already replicated by node
+				current = nil
 				break
 			}
 		}
-		if !isRangePresent {
+		for _, replica := range current {
+			sources[hr] = append(sources[hr], replica)
+		}
+	}
+	return sources
+}
+
+// GetHandoffTargets returns the ranges node replicates, each with the nodes
+// that will replicate it in its place once it has left
+func (r *Router) GetHandoffTargets(node string) map[HashRange][]*NodeInfo {
+	targets := make(map[HashRange][]*NodeInfo)
+	ring := r.Ring()
+	next := ring.Next()
+	for i := 0; i < ring.Len(); i++ {
+		current := make(map[string]bool)
+		for _, replica := range ring.Replicas(i) {
+			current[replica.Name] = true
+		}
+		if !current[node] {
 			continue
 		}
-		isRangePresent = false
-		for j := i; j < i+int(r.cfg.ReplicationFactor); j++ {
-			if r.cfg.Nodes[j%len(r.cfg.Nodes)].NodeHash == currNodeHash {
-				isRangePresent = true
-				break
+		hr := ring.Range(i)
+		// Ranges of the current ring never span a token of the next one
+		for _, replica := range next.ReplicasOf(hr.High) {
+			if !current[replica.Name] {
+				targets[hr] = append(targets[hr], replica)
 			}
 		}
-		if isRangePresent {
-			hashRanges = append(hashRanges, HashRange{Low: node.PrevNodeHash, High: node.NodeHash})
+	}
+	return targets
+}
+
+// Ownership is the share of the keyspace a node is responsible for, in percent
+type Ownership struct {
+	Tokens  int     `json:"tokens"`
+	Primary float64 `json:"primary"` // keys the node owns as first replica
+	Replica float64 `json:"replica"` // keys the node holds any replica of
+}
+
+// GetOwnership returns the ownership of every node by name
+func (r *Router) GetOwnership() map[string]*Ownership {
+	ownership := make(map[string]*Ownership)
+	ring := r.Ring()
+	for _, node := range ring.nodes {
+		ownership[node.Name] = &Ownership{Tokens: len(node.Tokens)}
+	}
+	for i, vn := range ring.vnodes {
+		share := 100.0
+		if ring.Len() > 1 {
+			share = RangeFraction(ring.Range(i)) * 100
+		}
+		ownership[vn.Node.Name].Primary += share
+		for _, node := range ring.Replicas(i) {
+			ownership[node.Name].Replica += share
 		}
 	}
-	return hashRanges
+	return ownership
+}
+
+// ProjectOwnership returns the ownership every node would have if node had the given weight
+func ProjectOwnership(cfg *Config, node string, weight float64) (map[string]*Ownership, error) {
+	projected := cfg.Copy()
+	found := false
+	for _, ni := range projected.Nodes {
+		if ni.Name == node {
+			ni.Weight = weight
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New(NODE_NOT_FOUND)
+	}
+	return CreateRouter(projected).GetOwnership(), nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestProjectOwnership(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    string
+		weight  float64
+		tokens  int
+		compare int // sign of the projected primary share of node minus the current one
+	}{
+		{"same weight", "n7001", 1, DefaultVNodes, 0},
+		{"heavier", "n7001", 2, 2 * DefaultVNodes, 1},
+		{"lighter", "n7002", 0.5, DefaultVNodes / 2, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(TWO, "", "", "", "")
+			current := CreateRouter(cfg).GetOwnership()
+			projected, err := ProjectOwnership(cfg, tt.node, tt.weight)
+			if err != nil {
+				t.Fatalf("projection failed: %s", err)
+			}
+			if cfg.GetNode(tt.node).Weight != 0 {
+				t.Fatalf("projection changed the config")
+			}
+			if got := projected[tt.node].Tokens; got != tt.tokens {
+				t.Fatalf("projected %d tokens, want %d", got, tt.tokens)
+			}
+			diff := projected[tt.node].Primary - current[tt.node].Primary
+			if tt.compare == 0 && math.Abs(diff) > 1e-9 ||
+				tt.compare > 0 && diff <= 0 || tt.compare < 0 && diff >= 0 {
+				t.Fatalf("primary share changed from %.2f%% to %.2f%%", current[tt.node].Primary, projected[tt.node].Primary)
+			}
+			var primary, replica float64
+			for _, o := range projected {
+				primary += o.Primary
+				replica += o.Replica
+			}
+			if math.Abs(primary-100) > 1e-6 || math.Abs(replica-200) > 1e-6 {
+				t.Fatalf("projected shares add up to %.4f%% primary and %.4f%% replica", primary, replica)
+			}
+		})
+	}
+	if _, err := ProjectOwnership(testConfig(TWO, "", ""), "n9999", 1); err == nil || err.Error() != NODE_NOT_FOUND {
+		t.Fatalf("projecting an unknown node returned %v, want %s", err, NODE_NOT_FOUND)
+	}
+}
@@ -1,23 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type APIServer struct {
-	h      *http.Server
-	addr   string
-	port   string
-	read   func(key string) (string, error)
-	write  func(key, value string) error
-	delete func(key string) error
-	repair func(otherNode string) error
+	h        *http.Server
+	addr     string
+	port     string
+	handlers map[string]http.HandlerFunc // extra endpoints added with AddHandler
+	read     func(key string) (*ReadResult, error)
+	write    func(key, value string, opts WriteOptions) error
+	delete   func(key string, opts WriteOptions) error
+	repair   func(otherNode string) error
 }
 
 // TODO: Refactor long argument list
-func InitServer(ni *NodeInfo, Read func(key string) (string, error), Write func(key, value string) error, Delete func(key string) error, Repair func(otherNode string) error) *APIServer {
+func InitServer(ni *NodeInfo, Read func(key string) (*ReadResult, error), Write func(key, value string, opts WriteOptions) error, Delete func(key string, opts WriteOptions) error, Repair func(otherNode string) error) *APIServer {
 	var s APIServer
 	s.read = Read
 	s.write = Write
@@ -25,9 +29,15 @@ func InitServer(ni *NodeInfo, Read func(key string) (string, error), Write func(
 	s.repair = Repair
 	s.addr = ni.Addr
 	s.port = ni.APIPort
+	s.handlers = make(map[string]http.HandlerFunc)
 	return &s
 }
 
+// AddHandler registers an extra endpoint, it must be called before Start
+func (s *APIServer) AddHandler(path string, handler http.HandlerFunc) {
+	s.handlers[path] = handler
+}
+
 func (s *APIServer) Start() error {
 	s.h = &http.Server{
 		Addr: s.addr + ":" + s.port,
@@ -37,10 +47,17 @@ func (s *APIServer) Start() error {
 	http.HandleFunc("/write", s.writeHandler)
 	http.HandleFunc("/delete", s.deleteHandler)
 	http.HandleFunc("/repair", s.repairHandler)
+	for path, handler := range s.handlers {
+		http.HandleFunc(path, handler)
+	}
 
 	log.Info("Starting server at " + s.addr + ":" + s.port)
 
 	err := s.h.ListenAndServe()
+	if err == http.ErrServerClosed {
+		log.Info("Server stopped")
+		return nil
+	}
 	if err != nil {
 		println(err.Error())
 		return err
@@ -51,29 +68,89 @@ func (s *APIServer) Start() error {
 func (s *APIServer) readHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	log.Infof("Server processing read request for key=%s", key)
-	value, err := s.read(key)
+	if IsInternalKey(key) {
+		writeError(w, errors.New(INVALID_KEY))
+		return
+	}
+	result, err := s.read(key)
 	if err != nil {
 		if err.Error() == KEY_NOT_FOUND {
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte(err.Error()))
 			return
 		}
+		if err.Error() == NODE_BOOTSTRAPPING {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if result.Context != "" {
+		w.Header().Set(ContextHeader, result.Context)
+	}
+	// Concurrent values are returned together as a JSON list
+	if len(result.Values) > 1 {
+		b, err := json.Marshal(result.Values)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultipleChoices)
+		w.Write(b)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(result.Values[0]))
+}
+
+// writeOptions reads the causal context from the query or the context header,
+// and whether sloppy quorum is allowed
+func writeOptions(r *http.Request) WriteOptions {
+	ctx := r.URL.Query().Get("context")
+	if ctx == "" {
+		ctx = r.Header.Get(ContextHeader)
+	}
+	sloppy, _ := strconv.ParseBool(r.URL.Query().Get("sloppy"))
+	return WriteOptions{Context: ctx, Sloppy: sloppy}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(value))
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if err.Error() == INVALID_CONTEXT || err.Error() == INVALID_KEY {
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
 }
 
 func (s *APIServer) writeHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	log.Infof("Server processing write request for key=%s", key)
+	if IsInternalKey(key) {
+		writeError(w, errors.New(INVALID_KEY))
+		return
+	}
 	value := r.URL.Query().Get("value")
-	err := s.write(key, value)
+	err := s.write(key, value, writeOptions(r))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -82,10 +159,13 @@ func (s *APIServer) writeHandler(w http.ResponseWriter, r *http.Request) {
 func (s *APIServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	log.Infof("Server processing delete request for key=%s", key)
-	err := s.delete(key)
+	if IsInternalKey(key) {
+		writeError(w, errors.New(INVALID_KEY))
+		return
+	}
+	err := s.delete(key, writeOptions(r))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -106,3 +186,7 @@ func (s *APIServer) repairHandler(w http.ResponseWriter, r *http.Request) {
 func (s *APIServer) Stop() {
 	s.h.Close()
 }
+
+const (
+	ContextHeader = "X-Causal-Context"
+)
@@ -0,0 +1,69 @@
+package main
+
+// StorageEngine is an ordered key value store the Engine keeps records,
+// Merkle trees and hints in
+type StorageEngine interface {
+	// Get returns the value of key, or nil if there is none
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Batch applies all operations atomically
+	Batch(ops []BatchOp) error
+	// Iterate calls f with every key in r and its value in key order,
+	// stopping at the first error. Keys and values may be retained.
+	Iterate(r KeyRange, f func(key, value []byte) error) error
+	// Snapshot returns a consistent view of the store as it is now
+	Snapshot() (StorageSnapshot, error)
+	Close() error
+	Stats() EngineStats
+}
+
+// StorageSnapshot is a read only view of a StorageEngine, it must be released
+type StorageSnapshot interface {
+	Get(key []byte) ([]byte, error)
+	Iterate(r KeyRange, f func(key, value []byte) error) error
+	Release()
+}
+
+// BatchOp sets Key to Value, or deletes it if Delete is set
+type BatchOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// KeyRange covers the keys from Start up to but excluding End. Nil bounds
+// are unbounded.
+type KeyRange struct {
+	Start    []byte
+	End      []byte
+	KeysOnly bool // values are passed as nil
+}
+
+// PrefixRange covers every key starting with prefix
+func PrefixRange(prefix []byte, keysOnly bool) KeyRange {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return KeyRange{Start: prefix, End: end[:i+1], KeysOnly: keysOnly}
+		}
+	}
+	return KeyRange{Start: prefix, KeysOnly: keysOnly}
+}
+
+// StorageKind selects the StorageEngine implementation
+type StorageKind string
+
+const (
+	BADGER StorageKind = "BADGER" // persistent, in the data directory
+	MEMORY StorageKind = "MEMORY" // lost when the node stops
+)
+
+// OpenStorage opens the storage of the named node
+func OpenStorage(local *LocalConfig, name string) StorageEngine {
+	if local.Storage == MEMORY {
+		return NewMemoryStorage()
+	}
+	return OpenBadgerStorage(local.NodeDataDir(name), local.Badger)
+}
@@ -1,256 +1,789 @@
 package main
 
 import (
-	"io/ioutil"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"math/rand"
-	"net/http"
-	"strings"
+	"net"
+	"sort"
 	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-type PNode struct {
-	port       string     // The port that this node is listening on
-	memberList []string   // The list of nodes that this node knows about
-	suspect    bool       // Whether this node is suspecting some other node to be dead
-	mu         sync.Mutex // Mutex to lock the memberList
+// SwimList is a membership implementing the SWIM protocol. Every probe
+// interval one member is pinged over UDP, if it does not ack other members
+// are asked to ping it. A member that still does not answer is suspected and
+// declared dead once the suspicion times out, unless it refutes it by
+// gossiping a higher incarnation number. Membership updates and broadcasts
+// are piggybacked on the probes, user messages and state syncs go over TCP.
+type SwimList struct {
+	name        string
+	incarnation uint64
+	members     map[string]*swimMember
+	probeOrder  []string
+	probeIdx    int
+	queue       []*swimQueued            // updates being disseminated
+	broadcasts  map[string]uint64        // highest sequence number seen of every broadcast key
+	bseq        uint64                   // sequence number of the last broadcast sent
+	acks        map[uint64]chan struct{} // probes waiting for an ack by sequence number
+	seq         uint64
+	udp         *net.UDPConn
+	tcp         net.Listener
+	delegate    *MemberListDelegate
+	events      *MemberListEvents
+	leaving     bool
+	stop        chan struct{}
+	mu          sync.Mutex
+}
+
+type swimMember struct {
+	Name        string   `json:"name"`
+	Addr        string   `json:"addr"`
+	Port        string   `json:"port"`
+	Incarnation uint64   `json:"inc"`
+	State       Liveness `json:"state"`
+	Meta        []byte   `json:"meta,omitempty"`
+}
+
+// swimUpdate is gossiped along with packets. It is either the state of a
+// member or, if Broadcast is set, a broadcast user message.
+type swimUpdate struct {
+	swimMember
+	From      string `json:"from,omitempty"` // node that suspected or declared the member dead, or sent the broadcast
+	Broadcast string `json:"bcast,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"` // orders the broadcasts of one sender
+	Msg       []byte `json:"msg,omitempty"`
+}
+
+type swimQueued struct {
+	update    *swimUpdate
+	transmits int
 }
 
-type PNodeHandler struct {
-	node *PNode
+func (u *swimUpdate) key() string {
+	if u.Broadcast != "" {
+		return "b:" + u.From + "/" + u.Broadcast
+	}
+	return "m:" + u.Name
 }
 
-func getExistingNodes(port string) []string {
-	resp, err := http.Get("http://localhost:" + port + "/nodes")
+type swimPacketType int
+
+const (
+	SWIM_PING swimPacketType = iota
+	SWIM_ACK
+	SWIM_PING_REQ // asks the receiver to ping Target and forward its ack
+	SWIM_USER
+)
+
+type swimPacket struct {
+	Type       swimPacketType `json:"type"`
+	Seq        uint64         `json:"seq"`
+	From       string         `json:"from"`
+	Target     string         `json:"target,omitempty"`
+	TargetAddr string         `json:"target_addr,omitempty"`
+	Msg        []byte         `json:"msg,omitempty"`
+	Updates    []*swimUpdate  `json:"updates,omitempty"`
+}
+
+// Frame types of TCP connections
+const (
+	SWIM_TCP_USER byte = iota
+	SWIM_TCP_PUSH_PULL
+)
+
+// swimPushPull is the full state exchanged when joining and periodically
+type swimPushPull struct {
+	Members []*swimMember `json:"members"`
+	State   []byte        `json:"state,omitempty"` // from the delegate
+}
+
+// CreateSwimList starts probing and gossiping as node, the delegate and
+// events receive messages, cluster state and membership changes
+func CreateSwimList(node *NodeInfo, delegate *MemberListDelegate, events *MemberListEvents) *SwimList {
+	udpAddr, err := net.ResolveUDPAddr("udp", node.Addr+":"+node.Port)
 	if err != nil {
 		panic(err)
 	}
-	defer resp.Body.Close()
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		panic(err)
+	}
+	tcp, err := net.Listen("tcp", node.Addr+":"+node.Port)
+	if err != nil {
+		panic(err)
+	}
+	s := &SwimList{
+		name:       node.Name,
+		members:    make(map[string]*swimMember),
+		broadcasts: make(map[string]uint64),
+		// Starts from the clock so a restarted node's broadcasts are not taken as old
+		bseq:     uint64(time.Now().UnixNano()),
+		acks:     make(map[uint64]chan struct{}),
+		udp:      udp,
+		tcp:      tcp,
+		delegate: delegate,
+		events:   events,
+		stop:     make(chan struct{}),
+	}
+	s.members[s.name] = &swimMember{
+		Name:  node.Name,
+		Addr:  node.Addr,
+		Port:  node.Port,
+		State: ALIVE,
+		Meta:  delegate.GetMeta(SwimMetaMaxSize),
+	}
+	s.enqueue(&swimUpdate{swimMember: *s.members[s.name]})
+
+	go s.readUDP()
+	go s.acceptTCP()
+	go s.probeLoop()
+	go s.pushPullLoop()
+	return s
+}
+
+func (s *SwimList) Join(seedNode *NodeInfo) error {
+	return s.pushPull(seedNode.Addr + ":" + seedNode.Port)
+}
+
+func (s *SwimList) Leave() error {
+	// Broadcasts still queued, like the config removing this node, would be
+	// lost with it. Hand the full state to some members instead.
+	for _, m := range s.randomMembers(SwimIndirectProbes, "") {
+		err := s.pushPull(m.Addr + ":" + m.Port)
+		if err != nil {
+			log.Debugf("SWIM push/pull with %s failed: %s", m.Name, err)
+		}
+	}
 
-	var nodes []string
-	if b, err := ioutil.ReadAll(resp.Body); err == nil {
-		nodes = strings.Split(string(b), ",")
+	s.mu.Lock()
+	s.leaving = true
+	self := s.members[s.name]
+	self.State = DEAD
+	leave := &swimUpdate{swimMember: *self, From: s.name}
+	var peers []*swimMember
+	for _, m := range s.members {
+		if m.Name != s.name && m.State != DEAD {
+			peers = append(peers, m)
+		}
+	}
+	s.mu.Unlock()
+
+	// Tell every member directly rather than waiting for the gossip to spread
+	for _, m := range peers {
+		s.sendPacket(m.Addr+":"+m.Port, &swimPacket{Type: SWIM_USER, From: s.name, Updates: []*swimUpdate{leave}})
 	}
-	return nodes
+	close(s.stop)
+	s.tcp.Close()
+	return s.udp.Close()
 }
 
-func NewPNode(port string, runningPort string) (p *PNode) {
-	n := PNode{port: port, memberList: []string{}}
-	if runningPort != "" {
-		n.memberList = getExistingNodes(runningPort)
+func (s *SwimList) SendTCP(msg []byte, name string) error {
+	m := s.findMember(name)
+	if m == nil {
+		return errors.New(NODE_UNREACHABLE)
 	}
-	n.memberList = append(n.memberList, port)
+	conn, err := net.DialTimeout("tcp", m.Addr+":"+m.Port, SwimTCPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SwimTCPTimeout))
+	return writeFrame(conn, SWIM_TCP_USER, msg)
+}
 
-	return &n
+func (s *SwimList) SendUDP(msg []byte, name string) error {
+	m := s.findMember(name)
+	if m == nil {
+		return errors.New(NODE_UNREACHABLE)
+	}
+	return s.sendPacket(m.Addr+":"+m.Port, &swimPacket{Type: SWIM_USER, From: s.name, Msg: msg})
 }
 
-func (p *PNode) SendDiscoveryMessage() {
-	// Wait for the server to start
-	time.Sleep(3 * time.Second)
-	p.mu.Lock()
-	println("discovering")
-	for _, node := range p.memberList {
-		if node != p.port {
-			var sendReq func(node string, tries int)
-			sendReq = func(node string, tries int) {
-				println("sending")
-				if tries == 0 {
-					return
-				}
-				client := &http.Client{}
-				req, _ := http.NewRequest("GET", "http://localhost:"+node+"/add", nil)
-				req.Header.Add("Node", p.port)
-				_, err := client.Do(req)
-				println("got response")
-				if err != nil {
-					sendReq(node, tries-1)
-				}
-			}
-			sendReq(node, 3)
+func (s *SwimList) Broadcast(name string, msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bseq++
+	u := &swimUpdate{Broadcast: name, From: s.name, Seq: s.bseq, Msg: msg}
+	s.broadcasts[u.key()] = u.Seq
+	s.enqueue(u)
+}
+
+// UpdateNode advertises the local metadata with a new incarnation, so it
+// overrides what other members know
+func (s *SwimList) UpdateNode() error {
+	meta := s.delegate.GetMeta(SwimMetaMaxSize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incarnation++
+	self := s.members[s.name]
+	self.Incarnation = s.incarnation
+	self.Meta = meta
+	s.enqueue(&swimUpdate{swimMember: *self})
+	return nil
+}
+
+func (s *SwimList) Meta() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta := make(map[string][]byte)
+	for _, m := range s.members {
+		if m.State != DEAD {
+			meta[m.Name] = m.Meta
 		}
 	}
-	println("discovery done")
-	p.mu.Unlock()
-	go p.CheckForRandomNodeFailure()
+	return meta
 }
 
-func (h *PNodeHandler) GetAllMemberNodes(w http.ResponseWriter, r *http.Request) {
-	h.node.mu.Lock()
-	nodes := strings.Join(h.node.memberList, ",")
-	h.node.mu.Unlock()
-	w.Write([]byte(nodes))
+func (s *SwimList) Members() []Member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var members []Member
+	for _, m := range s.members {
+		members = append(members, Member{Name: m.Name, State: m.State})
+	}
+	return members
 }
 
-func (h *PNodeHandler) Ping(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("pong"))
+func (s *SwimList) CheckIfNodeAlive(node *NodeInfo) bool {
+	return s.findMember(node.Name) != nil
 }
 
-func verifyAlive(node string) bool {
-	resp, err := http.Get("http://localhost:" + node + "/ping")
-	if err != nil {
-		return false
+func (s *SwimList) WaitForNode(name string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.findMember(name) == nil {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	defer resp.Body.Close()
 	return true
 }
 
-func (h *PNodeHandler) AddMemberNode(w http.ResponseWriter, r *http.Request) {
-	println("Request received to add", r.Header.Get("Node"))
-	node := r.Header.Get("Node")
-	if verifyAlive(node) {
-		println("waiting for lock")
-		h.node.mu.Lock()
-		println("got lock")
-		h.node.memberList = append(h.node.memberList, node)
-		h.node.mu.Unlock()
+// findMember returns a copy of the named member if it is not dead, the
+// name may be padded
+func (s *SwimList) findMember(name string) *swimMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.members {
+		if (m.Name == name || PadName(m.Name) == name) && m.State != DEAD {
+			member := *m
+			return &member
+		}
+	}
+	return nil
+}
+
+// enqueue starts disseminating u, replacing older updates about the same
+// member or broadcast. Caller must hold mu.
+func (s *SwimList) enqueue(u *swimUpdate) {
+	for i, q := range s.queue {
+		if q.update.key() == u.key() {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	s.queue = append(s.queue, &swimQueued{update: u})
+}
+
+// piggyback takes the updates fitting in limit bytes, least transmitted
+// first, and drops those sent often enough to have reached every member.
+// Caller must hold mu.
+func (s *SwimList) piggyback(limit int) []*swimUpdate {
+	sort.SliceStable(s.queue, func(i, j int) bool {
+		return s.queue[i].transmits < s.queue[j].transmits
+	})
+	maxTransmits := SwimRetransmitMult * int(math.Ceil(math.Log10(float64(len(s.members)+1))))
+	var updates []*swimUpdate
+	size := 0
+	kept := s.queue[:0]
+	for _, q := range s.queue {
+		b, err := json.Marshal(q.update)
+		if err != nil {
+			panic(err)
+		}
+		if size+len(b) <= limit {
+			size += len(b)
+			updates = append(updates, q.update)
+			q.transmits++
+		}
+		if q.transmits < maxTransmits {
+			kept = append(kept, q)
+		}
+	}
+	s.queue = kept
+	return updates
+}
+
+func (s *SwimList) sendPacket(addr string, p *swimPacket) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.sendPacketTo(udpAddr, p)
+}
+
+func (s *SwimList) sendPacketTo(addr *net.UDPAddr, p *swimPacket) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
 	}
+	s.mu.Lock()
+	p.Updates = append(p.Updates, s.piggyback(SwimPacketSize-len(b))...)
+	s.mu.Unlock()
+	b, err = json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	_, err = s.udp.WriteToUDP(b, addr)
+	return err
 }
 
-func (h *PNodeHandler) RemoveMemberNode(w http.ResponseWriter, r *http.Request) {
-	println("Request received to remove", r.Header.Get("Node"))
-	node := r.Header.Get("Node")
-	go func() {
-		h.node.mu.Lock()
-		defer h.node.mu.Unlock()
-		for i, n := range h.node.memberList {
-			if n == node {
-				h.node.memberList = append(h.node.memberList[:i], h.node.memberList[i+1:]...)
+func (s *SwimList) readUDP() {
+	buf := make([]byte, SwimMaxPacketSize)
+	for {
+		size, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.stop:
 				return
+			default:
 			}
+			log.Debugf("SWIM could not read packet: %s", err)
+			continue
+		}
+		var p swimPacket
+		err = json.Unmarshal(buf[:size], &p)
+		if err != nil {
+			log.Debugf("SWIM dropped invalid packet from %s: %s", addr, err)
+			continue
 		}
-	}()
+		s.handlePacket(&p, addr)
+	}
+}
+
+func (s *SwimList) handlePacket(p *swimPacket, addr *net.UDPAddr) {
+	s.apply(p.Updates)
+	switch p.Type {
+	case SWIM_PING:
+		// A restarted node at the same address may be pinged under another name
+		if p.Target == s.name {
+			s.sendPacketTo(addr, &swimPacket{Type: SWIM_ACK, Seq: p.Seq, From: s.name})
+		}
+	case SWIM_ACK:
+		s.mu.Lock()
+		if ack, ok := s.acks[p.Seq]; ok {
+			close(ack)
+			delete(s.acks, p.Seq)
+		}
+		s.mu.Unlock()
+	case SWIM_PING_REQ:
+		go s.probeFor(p, addr)
+	case SWIM_USER:
+		if len(p.Msg) > 0 {
+			go s.delegate.ProcessMsg(p.Msg)
+		}
+	}
+}
+
+// probeFor pings the target of a ping request and forwards its ack
+func (s *SwimList) probeFor(req *swimPacket, from *net.UDPAddr) {
+	seq, ack := s.expectAck()
+	s.sendPacket(req.TargetAddr, &swimPacket{Type: SWIM_PING, Seq: seq, From: s.name, Target: req.Target})
+	select {
+	case <-ack:
+		s.sendPacketTo(from, &swimPacket{Type: SWIM_ACK, Seq: req.Seq, From: s.name})
+	case <-time.After(SwimProbeTimeout):
+		s.cancelAck(seq)
+	}
+}
+
+func (s *SwimList) expectAck() (uint64, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	ack := make(chan struct{})
+	s.acks[s.seq] = ack
+	return s.seq, ack
 }
 
-func (h *PNodeHandler) CheckSuspectNode(w http.ResponseWriter, r *http.Request) {
-	println("Request received to check", r.Header.Get("Node"))
-	node := r.Header.Get("Node")
+func (s *SwimList) cancelAck(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.acks, seq)
+}
 
-	var sendReq func(node string, tries int)
-	sendReq = func(node string, tries int) {
-		if tries == 0 {
+func (s *SwimList) probeLoop() {
+	ticker := time.NewTicker(SwimProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
 			return
+		case <-ticker.C:
+			s.probe()
 		}
-		if verifyAlive(node) {
-			client := &http.Client{}
-			req, _ := http.NewRequest("POST", "http://localhost:"+r.Header.Get("From")+"/check-suspect-ack", nil)
-			_, err := client.Do(req)
-			if err != nil {
-				sendReq(node, tries-1)
+	}
+}
+
+// nextProbeTarget walks the members in a random order, reshuffled after
+// every round so each member is probed once per round
+func (s *SwimList) nextProbeTarget() *swimMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tries := 0; tries <= len(s.probeOrder); tries++ {
+		if s.probeIdx >= len(s.probeOrder) {
+			s.probeOrder = s.probeOrder[:0]
+			for name := range s.members {
+				if name != s.name {
+					s.probeOrder = append(s.probeOrder, name)
+				}
 			}
+			rand.Shuffle(len(s.probeOrder), func(i, j int) {
+				s.probeOrder[i], s.probeOrder[j] = s.probeOrder[j], s.probeOrder[i]
+			})
+			s.probeIdx = 0
+		}
+		if len(s.probeOrder) == 0 {
+			return nil
+		}
+		m := s.members[s.probeOrder[s.probeIdx]]
+		s.probeIdx++
+		if m != nil && m.State != DEAD {
+			member := *m
+			return &member
 		}
 	}
-	go sendReq(node, 1)
+	return nil
 }
 
-func (h *PNodeHandler) CheckSuspectNodeAck(w http.ResponseWriter, r *http.Request) {
-	h.node.suspect = false
-}
+func (s *SwimList) probe() {
+	target := s.nextProbeTarget()
+	if target == nil {
+		return
+	}
+	addr := target.Addr + ":" + target.Port
+	seq, ack := s.expectAck()
+	defer s.cancelAck(seq)
+	s.sendPacket(addr, &swimPacket{Type: SWIM_PING, Seq: seq, From: s.name, Target: target.Name})
+	select {
+	case <-ack:
+		return
+	case <-time.After(SwimProbeTimeout):
+	}
 
-func (p *PNode) CheckForRandomNodeFailure() {
-	// Wait T seconds every time
-	time.Sleep(WaitBeforeCheckTime)
-	p.mu.Lock()
-	println("Currently has", len(p.memberList), "nodes")
-	// Pick a random node
-	if len(p.memberList) == 1 {
-		p.mu.Unlock()
-		p.CheckForRandomNodeFailure()
+	// Other members may still reach it, the problem may be on our side
+	for _, m := range s.randomMembers(SwimIndirectProbes, target.Name) {
+		s.sendPacket(m.Addr+":"+m.Port, &swimPacket{
+			Type:       SWIM_PING_REQ,
+			Seq:        seq,
+			From:       s.name,
+			Target:     target.Name,
+			TargetAddr: addr,
+		})
+	}
+	select {
+	case <-ack:
 		return
+	case <-time.After(SwimProbeInterval - SwimProbeTimeout):
 	}
+	s.apply([]*swimUpdate{{swimMember: swimMember{Name: target.Name, Incarnation: target.Incarnation, State: SUSPECT}, From: s.name}})
+}
 
-	rNum := rand.Intn(len(p.memberList) - 1)
-	i := 0
-	bef := false
-	for i <= rNum {
-		if p.port == p.memberList[i] {
-			bef = true
+// randomMembers returns up to k alive members other than this node and exclude
+func (s *SwimList) randomMembers(k int, exclude string) []*swimMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var candidates []*swimMember
+	for _, m := range s.members {
+		if m.Name != s.name && m.Name != exclude && m.State == ALIVE {
+			member := *m
+			candidates = append(candidates, &member)
 		}
-		i++
 	}
-	if bef {
-		rNum++
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
 	}
+	return candidates
+}
 
-	checkedNode := p.memberList[rNum]
+// apply merges gossiped updates into the member table and reports the
+// resulting membership changes
+func (s *SwimList) apply(updates []*swimUpdate) {
+	var notify []func()
+	s.mu.Lock()
+	for _, u := range updates {
+		if u.Broadcast != "" {
+			if !s.newBroadcast(u) {
+				continue
+			}
+			msg := u.Msg
+			notify = append(notify, func() { go s.delegate.ProcessMsg(msg) })
+			continue
+		}
+		notify = append(notify, s.applyMember(u)...)
+	}
+	s.mu.Unlock()
+	for _, f := range notify {
+		f()
+	}
+}
 
-	println("Randomly checking node", checkedNode, "for failure")
+// newBroadcast reports whether u was not received before. New broadcasts
+// are disseminated further, so they reach every member even if the sender
+// fails. Caller must hold mu.
+func (s *SwimList) newBroadcast(u *swimUpdate) bool {
+	if u.Seq == 0 {
+		// From a node not numbering its broadcasts, it retransmits them itself
+		return true
+	}
+	if u.From == s.name || s.broadcasts[u.key()] >= u.Seq {
+		return false
+	}
+	s.broadcasts[u.key()] = u.Seq
+	s.enqueue(u)
+	return true
+}
 
-	if verifyAlive(checkedNode) {
-		p.mu.Unlock()
-		p.CheckForRandomNodeFailure()
-		return
+// applyMember applies an update about one member. A member's own alive
+// updates win over suspicions of the same incarnation, suspicions over alive
+// updates and dead over both. Caller must hold mu.
+func (s *SwimList) applyMember(u *swimUpdate) (notify []func()) {
+	if u.Name == s.name {
+		s.refute(u)
+		return nil
+	}
+	m, known := s.members[u.Name]
+	switch u.State {
+	case ALIVE:
+		if known && u.Incarnation <= m.Incarnation {
+			return nil
+		}
+		if !known {
+			m = &swimMember{Name: u.Name}
+			s.members[u.Name] = m
+		}
+		prev, prevMeta := m.State, m.Meta
+		m.Addr, m.Port, m.Incarnation, m.State, m.Meta = u.Addr, u.Port, u.Incarnation, ALIVE, u.Meta
+		name, meta := m.Name, m.Meta
+		if !known || prev == DEAD {
+			notify = append(notify, func() {
+				s.events.OnMeta(name, meta)
+				s.events.OnJoin(name)
+			})
+		} else if string(prevMeta) != string(meta) {
+			notify = append(notify, func() { s.events.OnMeta(name, meta) })
+		}
+	case SUSPECT:
+		if !known || m.State == DEAD || u.Incarnation < m.Incarnation ||
+			(m.State == SUSPECT && u.Incarnation == m.Incarnation) {
+			return nil
+		}
+		m.Incarnation, m.State = u.Incarnation, SUSPECT
+		log.Debugf("SWIM suspects %s, reported by %s", m.Name, u.From)
+		inc := m.Incarnation
+		time.AfterFunc(s.suspicionTimeout(), func() { s.suspicionExpired(u.Name, inc) })
+	case DEAD:
+		if !known || m.State == DEAD || u.Incarnation < m.Incarnation {
+			return nil
+		}
+		m.Incarnation, m.State = u.Incarnation, DEAD
+		name := m.Name
+		notify = append(notify, func() { s.events.OnLeave(name) })
+	default:
+		return nil
 	}
-	i = 0
-	j := 0
-	// randomize the list
-	lst := make([]string, len(p.memberList))
-	copy(lst, p.memberList)
-	for i < len(lst) {
-		r := rand.Intn(len(lst))
-		lst[i], lst[r] = lst[r], lst[i]
-		i++
+	s.enqueue(&swimUpdate{swimMember: *m, From: u.From})
+	return notify
+}
+
+// refute answers suspicions and death declarations about this node with a
+// higher incarnation, unless it is leaving. Caller must hold mu.
+func (s *SwimList) refute(u *swimUpdate) {
+	if s.leaving || u.Incarnation < s.incarnation || (u.State == ALIVE && u.Incarnation == s.incarnation) {
+		return
 	}
+	s.incarnation = u.Incarnation + 1
+	self := s.members[s.name]
+	self.Incarnation = s.incarnation
+	s.enqueue(&swimUpdate{swimMember: *self})
+}
 
-	p.suspect = true
+// suspicionTimeout grows with the cluster size, as suspicions take longer
+// to reach every member. Caller must hold mu.
+func (s *SwimList) suspicionTimeout() time.Duration {
+	scale := math.Max(1, math.Log10(float64(len(s.members))))
+	return time.Duration(float64(SwimSuspicionMult*SwimProbeInterval) * scale)
+}
 
-	i = 0
+func (s *SwimList) suspicionExpired(name string, incarnation uint64) {
+	s.mu.Lock()
+	m, ok := s.members[name]
+	expired := ok && m.State == SUSPECT && m.Incarnation == incarnation
+	s.mu.Unlock()
+	if expired {
+		s.apply([]*swimUpdate{{swimMember: swimMember{Name: name, Incarnation: incarnation, State: DEAD}, From: s.name}})
+	}
+}
 
-	for i < len(lst) && j < KNodes {
-		if lst[i] == checkedNode || lst[i] == p.port {
-			i++
-			continue
-		}
-		// ask node to check if it knows about the failed node
-		var sendReq func(node string, tries int)
-		sendReq = func(node string, tries int) {
-			if tries == 0 {
-				return
+func (s *SwimList) pushPullLoop() {
+	ticker := time.NewTicker(SwimPushPullInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			peers := s.randomMembers(1, "")
+			if len(peers) == 0 {
+				continue
 			}
-			client := &http.Client{}
-			req, _ := http.NewRequest("POST", "http://localhost:"+node+"/check-suspect", nil)
-			req.Header.Add("Node", checkedNode)
-			req.Header.Add("From", p.port)
-			_, err := client.Do(req)
+			err := s.pushPull(peers[0].Addr + ":" + peers[0].Port)
 			if err != nil {
-				sendReq(node, tries-1)
+				log.Debugf("SWIM push/pull with %s failed: %s", peers[0].Name, err)
 			}
 		}
-		sendReq(lst[i], 1)
-		j++
-		i++
-	}
-
-	time.Sleep(WaitBeforeCheckTime)
-	if p.suspect {
-		// remove the node from the list
-		// send a message to all nodes to remove the failed node
-		for _, node := range lst {
-			if node != p.port && node != checkedNode {
-				var sendReq func(node string, tries int)
-				sendReq = func(node string, tries int) {
-					if tries == 0 {
-						return
-					}
-					client := &http.Client{}
-					req, _ := http.NewRequest("POST", "http://localhost:"+node+"/remove", nil)
-					req.Header.Add("Node", checkedNode)
-					_, err := client.Do(req)
-					if err != nil {
-						sendReq(node, tries-1)
-					}
-				}
-				sendReq(node, 1)
+	}
+}
+
+// localState returns the member table and the delegate's state
+func (s *SwimList) localState() *swimPushPull {
+	state := &swimPushPull{State: s.delegate.GetState()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.members {
+		member := *m
+		state.Members = append(state.Members, &member)
+	}
+	return state
+}
+
+func (s *SwimList) mergeState(state *swimPushPull) {
+	var updates []*swimUpdate
+	for _, m := range state.Members {
+		updates = append(updates, &swimUpdate{swimMember: *m})
+	}
+	s.apply(updates)
+	if len(state.State) > 0 {
+		s.delegate.MergeState(state.State)
+	}
+}
+
+// pushPull exchanges the full state with the member at addr
+func (s *SwimList) pushPull(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, SwimTCPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SwimTCPTimeout))
+	b, err := json.Marshal(s.localState())
+	if err != nil {
+		panic(err)
+	}
+	err = writeFrame(conn, SWIM_TCP_PUSH_PULL, b)
+	if err != nil {
+		return err
+	}
+	_, b, err = readFrame(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	var remote swimPushPull
+	err = json.Unmarshal(b, &remote)
+	if err != nil {
+		return err
+	}
+	s.mergeState(&remote)
+	return nil
+}
+
+func (s *SwimList) acceptTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
 			}
+			log.Debugf("SWIM could not accept connection: %s", err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *SwimList) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SwimTCPTimeout))
+	frameType, b, err := readFrame(bufio.NewReader(conn))
+	if err != nil {
+		log.Debugf("SWIM could not read from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	switch frameType {
+	case SWIM_TCP_USER:
+		s.delegate.ProcessMsg(b)
+	case SWIM_TCP_PUSH_PULL:
+		var remote swimPushPull
+		err = json.Unmarshal(b, &remote)
+		if err != nil {
+			log.Debugf("SWIM dropped invalid state from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		// Reply first so the remote side gets our state before the merge
+		// triggers membership events
+		b, err = json.Marshal(s.localState())
+		if err != nil {
+			panic(err)
 		}
-		println("Removed", checkedNode, "from the list")
-		p.memberList = append(p.memberList[:rNum], p.memberList[rNum+1:]...)
+		writeFrame(conn, SWIM_TCP_PUSH_PULL, b)
+		s.mergeState(&remote)
+	}
+}
+
+// Frames are a type byte, the big endian payload length and the payload
+func writeFrame(w io.Writer, frameType byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
 	}
-	p.suspect = false
-	p.mu.Unlock()
-	p.CheckForRandomNodeFailure()
+	return header[0], payload, nil
 }
 
 const (
-	WaitBeforeCheckTime = 3 * time.Second
-	KNodes              = 3
+	SwimProbeInterval    = 1 * time.Second
+	SwimProbeTimeout     = 500 * time.Millisecond
+	SwimIndirectProbes   = 3
+	SwimSuspicionMult    = 5 // probe intervals a suspected member has to refute
+	SwimRetransmitMult   = 4
+	SwimPushPullInterval = 30 * time.Second
+	SwimTCPTimeout       = 10 * time.Second
+	SwimPacketSize       = 1400 // fits in an ethernet frame
+	SwimMaxPacketSize    = 65536
+	SwimMetaMaxSize      = 512
 )
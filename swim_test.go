@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestSwimList returns a SwimList without network connections, for
+// testing how it applies updates
+func newTestSwimList(name string) *SwimList {
+	s := &SwimList{
+		name:       name,
+		members:    make(map[string]*swimMember),
+		broadcasts: make(map[string]uint64),
+		acks:       make(map[uint64]chan struct{}),
+		delegate: &MemberListDelegate{
+			ProcessMsg: func([]byte) {},
+			GetMeta:    func(int) []byte { return nil },
+		},
+		events: &MemberListEvents{
+			OnJoin:  func(string) {},
+			OnLeave: func(string) {},
+			OnMeta:  func(string, []byte) {},
+		},
+	}
+	s.members[name] = &swimMember{Name: name, State: ALIVE}
+	return s
+}
+
+// queued returns the queued update with key, or nil
+func (s *SwimList) queued(key string) *swimUpdate {
+	for _, q := range s.queue {
+		if q.update.key() == key {
+			return q.update
+		}
+	}
+	return nil
+}
+
+func TestSwimRelaysBroadcasts(t *testing.T) {
+	tests := []struct {
+		name    string
+		seen    uint64 // sequence number seen before, 0 if none
+		update  *swimUpdate
+		deliver bool
+		relay   bool
+	}{
+		{"new", 0, &swimUpdate{Broadcast: "config", From: "n7002", Seq: 2}, true, true},
+		{"newer", 1, &swimUpdate{Broadcast: "config", From: "n7002", Seq: 2}, true, true},
+		{"seen", 2, &swimUpdate{Broadcast: "config", From: "n7002", Seq: 2}, false, false},
+		{"older", 3, &swimUpdate{Broadcast: "config", From: "n7002", Seq: 2}, false, false},
+		{"own", 0, &swimUpdate{Broadcast: "config", From: "n7001", Seq: 2}, false, false},
+		{"unnumbered", 0, &swimUpdate{Broadcast: "config", From: "n7002"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSwimList("n7001")
+			delivered := make(chan []byte, 1)
+			s.delegate.ProcessMsg = func(msg []byte) { delivered <- msg }
+			if tt.seen != 0 {
+				s.broadcasts[tt.update.key()] = tt.seen
+			}
+			tt.update.Msg = []byte("msg")
+
+			s.apply([]*swimUpdate{tt.update})
+			if relayed := s.queued(tt.update.key()) != nil; relayed != tt.relay {
+				t.Errorf("relayed %t, want %t", relayed, tt.relay)
+			}
+			if tt.deliver {
+				if msg := <-delivered; string(msg) != "msg" {
+					t.Errorf("delivered %q, want msg", msg)
+				}
+			} else {
+				select {
+				case <-delivered:
+					t.Errorf("delivered a broadcast received before")
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		})
+	}
+}
+
+func swimState(name string, incarnation uint64, state Liveness) *swimUpdate {
+	return &swimUpdate{swimMember: swimMember{Name: name, Incarnation: incarnation, State: state}, From: "n7003"}
+}
+
+func TestSwimMemberStates(t *testing.T) {
+	tests := []struct {
+		name        string
+		updates     []*swimUpdate
+		state       Liveness
+		incarnation uint64
+		events      string // J for every join, L for every leave
+	}{
+		{"join", []*swimUpdate{swimState("n7002", 0, ALIVE)}, ALIVE, 0, "J"},
+		{"unknown suspect ignored", []*swimUpdate{swimState("n7002", 0, SUSPECT)}, "", 0, ""},
+		{"suspect", []*swimUpdate{swimState("n7002", 1, ALIVE), swimState("n7002", 1, SUSPECT)}, SUSPECT, 1, "J"},
+		{"old suspicion ignored", []*swimUpdate{swimState("n7002", 2, ALIVE), swimState("n7002", 1, SUSPECT)}, ALIVE, 2, "J"},
+		{"suspicion wins same incarnation", []*swimUpdate{swimState("n7002", 1, ALIVE), swimState("n7002", 1, SUSPECT), swimState("n7002", 1, ALIVE)}, SUSPECT, 1, "J"},
+		{"refuted", []*swimUpdate{swimState("n7002", 1, ALIVE), swimState("n7002", 1, SUSPECT), swimState("n7002", 2, ALIVE)}, ALIVE, 2, "J"},
+		{"confirmed dead", []*swimUpdate{swimState("n7002", 1, ALIVE), swimState("n7002", 1, SUSPECT), swimState("n7002", 1, DEAD)}, DEAD, 1, "JL"},
+		{"dead without suspicion", []*swimUpdate{swimState("n7002", 1, ALIVE), swimState("n7002", 1, DEAD)}, DEAD, 1, "JL"},
+		{"dead wins over alive", []*swimUpdate{swimState("n7002", 1, ALIVE), swimState("n7002", 1, DEAD), swimState("n7002", 1, ALIVE)}, DEAD, 1, "JL"},
+		{"rejoin", []*swimUpdate{swimState("n7002", 1, ALIVE), swimState("n7002", 1, DEAD), swimState("n7002", 2, ALIVE)}, ALIVE, 2, "JLJ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSwimList("n7001")
+			events := ""
+			s.events.OnJoin = func(string) { events += "J" }
+			s.events.OnLeave = func(string) { events += "L" }
+			s.apply(tt.updates)
+			var state Liveness
+			var incarnation uint64
+			if m := s.members["n7002"]; m != nil {
+				state, incarnation = m.State, m.Incarnation
+			}
+			if state != tt.state || incarnation != tt.incarnation {
+				t.Fatalf("member is %s at incarnation %d, want %s at %d", state, incarnation, tt.state, tt.incarnation)
+			}
+			if events != tt.events {
+				t.Fatalf("reported events %q, want %q", events, tt.events)
+			}
+		})
+	}
+}
+
+func TestSwimSuspicionExpires(t *testing.T) {
+	tests := []struct {
+		name        string
+		incarnation uint64 // of the expiring suspicion
+		state       Liveness
+	}{
+		{"confirmed", 1, DEAD},
+		{"refuted meanwhile", 0, ALIVE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSwimList("n7001")
+			s.apply([]*swimUpdate{swimState("n7002", 0, ALIVE), swimState("n7002", 0, SUSPECT), swimState("n7002", 1, ALIVE)})
+			if tt.state == DEAD {
+				s.apply([]*swimUpdate{swimState("n7002", 1, SUSPECT)})
+			}
+			s.suspicionExpired("n7002", tt.incarnation)
+			if state := s.members["n7002"].State; state != tt.state {
+				t.Fatalf("member is %s, want %s", state, tt.state)
+			}
+		})
+	}
+}
+
+func TestSwimRefutesSuspicionOfItself(t *testing.T) {
+	tests := []struct {
+		name        string
+		start       uint64 // incarnation of this node before the update
+		update      *swimUpdate
+		leaving     bool
+		incarnation uint64 // incarnation afterwards
+		refuted     bool
+	}{
+		{"suspected", 0, swimState("n7001", 0, SUSPECT), false, 1, true},
+		{"declared dead", 2, swimState("n7001", 3, DEAD), false, 4, true},
+		{"old suspicion", 5, swimState("n7001", 4, SUSPECT), false, 5, false},
+		{"alive", 5, swimState("n7001", 5, ALIVE), false, 5, false},
+		{"leaving", 5, swimState("n7001", 5, DEAD), true, 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSwimList("n7001")
+			s.incarnation = tt.start
+			s.members["n7001"].Incarnation = tt.start
+			s.leaving = tt.leaving
+			s.apply([]*swimUpdate{tt.update})
+			if s.incarnation != tt.incarnation {
+				t.Fatalf("incarnation is %d, want %d", s.incarnation, tt.incarnation)
+			}
+			refutation := s.queued("m:n7001")
+			if (refutation != nil) != tt.refuted {
+				t.Fatalf("refutation queued is %t, want %t", refutation != nil, tt.refuted)
+			}
+			if refutation != nil && (refutation.State != ALIVE || refutation.Incarnation != tt.incarnation) {
+				t.Fatalf("refuted with %s at incarnation %d", refutation.State, refutation.Incarnation)
+			}
+		})
+	}
+}
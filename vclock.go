@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+)
+
+// VectorClock maps node names to the dot counter of the latest write they
+// coordinated that is known
+type VectorClock map[string]uint64
+
+func (vc VectorClock) Copy() VectorClock {
+	c := make(VectorClock, len(vc))
+	for node, counter := range vc {
+		c[node] = counter
+	}
+	return c
+}
+
+// Merge returns the pairwise maximum of both clocks
+func (vc VectorClock) Merge(o VectorClock) VectorClock {
+	c := vc.Copy()
+	for node, counter := range o {
+		if counter > c[node] {
+			c[node] = counter
+		}
+	}
+	return c
+}
+
+// Every version is identified by a dot, the node that coordinated the write
+// and a counter derived from the write's timestamp. A node's timestamps only
+// grow, so its dots are unique and increasing without storing a counter.
+// Versions are obsoleted by the versions whose causal context covers their
+// dot, so writes through the same node with the same context stay siblings.
+
+// DotCounter returns the counter of the dot of a write made at ts
+func DotCounter(ts Timestamp) uint64 {
+	return uint64(ts.WallTime)<<20 + uint64(ts.Logical)
+}
+
+// Covers reports whether the version r was seen by a write with context vc
+func (vc VectorClock) Covers(r *Record) bool {
+	return vc[r.Origin] >= DotCounter(r.Timestamp)
+}
+
+// History returns the context covering every version of r, which is handed
+// to clients so their next write obsoletes all of them
+func History(r *Record) VectorClock {
+	vc := VectorClock{}
+	for _, s := range siblingsOf(r) {
+		vc = vc.Merge(s.VClock).Merge(VectorClock{s.Origin: DotCounter(s.Timestamp)})
+	}
+	return vc
+}
+
+func (vc VectorClock) nodes() []string {
+	nodes := make([]string, 0, len(vc))
+	for node := range vc {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func appendVectorClock(b []byte, vc VectorClock) []byte {
+	b = append(b, byte(len(vc)>>8), byte(len(vc)))
+	for _, node := range vc.nodes() {
+		b = append(b, byte(len(node)))
+		b = append(b, node...)
+		b = appendUint64(b, vc[node])
+	}
+	return b
+}
+
+func (d *recordDecoder) vectorClock() VectorClock {
+	count := int(d.byte())<<8 | int(d.byte())
+	if count == 0 {
+		return nil
+	}
+	vc := make(VectorClock, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		node := string(d.bytes(int(d.byte())))
+		vc[node] = d.uint64()
+	}
+	return vc
+}
+
+// EncodeContext turns a clock into the opaque causal context token handed to clients
+func EncodeContext(vc VectorClock) string {
+	if len(vc) == 0 {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(appendVectorClock(nil, vc))
+}
+
+func DecodeContext(token string) (VectorClock, error) {
+	if token == "" {
+		return VectorClock{}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New(INVALID_CONTEXT)
+	}
+	d := recordDecoder{b: b}
+	vc := d.vectorClock()
+	if d.err != nil || len(d.b) != 0 {
+		return nil, errors.New(INVALID_CONTEXT)
+	}
+	if vc == nil {
+		vc = VectorClock{}
+	}
+	return vc, nil
+}
+
+// siblingsOf returns the versions held by a record, a record without
+// siblings is a single version
+func siblingsOf(r *Record) []*Record {
+	if r == nil {
+		return nil
+	}
+	if len(r.Siblings) > 0 {
+		return r.Siblings
+	}
+	return []*Record{r}
+}
+
+// MergeSiblings combines the versions of two records, dropping every version
+// obsoleted by another one and duplicates of the same write
+func MergeSiblings(a, b *Record) *Record {
+	candidates := append(append([]*Record{}, siblingsOf(a)...), siblingsOf(b)...)
+	var siblings []*Record
+	for i, c := range candidates {
+		keep := true
+		for j, o := range candidates {
+			if i == j {
+				continue
+			}
+			sameWrite := c.Origin == o.Origin && c.Timestamp == o.Timestamp
+			if o.VClock.Covers(c) || (sameWrite && j < i) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			siblings = append(siblings, c)
+		}
+	}
+	if len(siblings) == 0 {
+		return nil
+	}
+	sort.Slice(siblings, func(i, j int) bool {
+		return siblings[i].Timestamp.Less(siblings[j].Timestamp)
+	})
+
+	merged := &Record{Tombstone: true, VClock: History(&Record{Siblings: siblings})}
+	for _, s := range siblings {
+		merged.Timestamp = s.Timestamp
+		merged.Tombstone = merged.Tombstone && s.Tombstone
+		merged.Siblings = append(merged.Siblings, s.withoutSiblings())
+	}
+	return merged
+}
+
+func (r *Record) withoutSiblings() *Record {
+	c := *r
+	c.Siblings = nil
+	return &c
+}
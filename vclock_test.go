@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testWrite returns a write coordinated by origin at wall time ms with context vc
+func testWrite(origin string, ms int64, value string, vc VectorClock) *Record {
+	return &Record{
+		Timestamp: Timestamp{WallTime: ms, NodeID: PadName(origin)},
+		Origin:    origin,
+		Value:     []byte(value),
+		Tombstone: value == "",
+		VClock:    vc,
+	}
+}
+
+// dot returns the context of having seen the write of origin at wall time ms
+func dot(origin string, ms int64) VectorClock {
+	return VectorClock{origin: DotCounter(Timestamp{WallTime: ms, NodeID: PadName(origin)})}
+}
+
+func TestMergeSiblings(t *testing.T) {
+	a := testWrite("n7001", 1, "a", nil)
+	b := testWrite("n7002", 2, "b", nil)
+	c := testWrite("n7001", 3, "c", dot("n7001", 1))
+	d := testWrite("n7002", 4, "", dot("n7002", 2))
+	tests := []struct {
+		name      string
+		a, b      *Record
+		want      []string // values of the siblings kept, in timestamp order
+		tombstone bool
+	}{
+		{"nothing stored", nil, a, []string{"a"}, false},
+		{"concurrent writes", a, b, []string{"a", "b"}, false},
+		{"concurrent writes reversed", b, a, []string{"a", "b"}, false},
+		{"same write twice", a, a, []string{"a"}, false},
+		{"newer write covers", a, c, []string{"c"}, false},
+		{"older write covered", c, a, []string{"c"}, false},
+		{"covers one of the siblings", MergeSiblings(a, b), c, []string{"b", "c"}, false},
+		{"delete of one sibling", MergeSiblings(a, b), d, []string{"a", ""}, false},
+		{"deletes of every sibling", MergeSiblings(testWrite("n7001", 1, "", nil), b), d, []string{"", ""}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := MergeSiblings(tt.a, tt.b)
+			var values []string
+			for _, s := range merged.Siblings {
+				values = append(values, string(s.Value))
+				if len(s.Siblings) > 0 {
+					t.Fatalf("sibling %q has nested siblings", s.Value)
+				}
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Fatalf("kept %q, want %q", values, tt.want)
+			}
+			if merged.Tombstone != tt.tombstone {
+				t.Fatalf("tombstone is %t, want %t", merged.Tombstone, tt.tombstone)
+			}
+			// The context handed to clients covers every sibling
+			for _, s := range merged.Siblings {
+				if !History(merged).Covers(s) {
+					t.Fatalf("history does not cover sibling %q", s.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestContextEncoding(t *testing.T) {
+	tests := []VectorClock{
+		{},
+		{"n7001": 1},
+		{"n7001": 1 << 40, "n7002": 7},
+	}
+	for _, vc := range tests {
+		decoded, err := DecodeContext(EncodeContext(vc))
+		if err != nil {
+			t.Fatalf("decoding %v failed: %s", vc, err)
+		}
+		if !reflect.DeepEqual(decoded, vc) {
+			t.Fatalf("decoded %v, want %v", decoded, vc)
+		}
+	}
+	if _, err := DecodeContext("not a context"); err == nil || err.Error() != INVALID_CONTEXT {
+		t.Fatalf("decoding garbage returned %v, want %s", err, INVALID_CONTEXT)
+	}
+}
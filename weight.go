@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetWeight changes the weight of a node. If that changes its number of
+// tokens the new weight is only set as pending: the ring formed with it
+// becomes the next ring, so writes also reach the nodes gaining ranges, and
+// the node moves the ranges it gains or loses before the weight is applied.
+func (n *Node) SetWeight(name string, weight float64) error {
+	return n.UpdateConfig(func(cfg *Config) error {
+		node := cfg.GetNode(name)
+		if node == nil {
+			return errors.New(NODE_NOT_FOUND)
+		}
+		if node.Status != NORMAL && node.Status != "" {
+			return errors.New(NODE_NOT_NORMAL)
+		}
+		if node.NewWeight != 0 {
+			return errors.New(WEIGHT_CHANGING)
+		}
+		changed := *node
+		changed.Weight = weight
+		if changed.TokenCount(cfg.VNodes) == node.TokenCount(cfg.VNodes) {
+			node.Weight = weight
+			return nil
+		}
+		log.Infof("Changing weight of %s to %g", name, weight)
+		node.NewWeight = weight
+		return nil
+	})
+}
+
+// reweight streams the ranges this node gains with its pending weight from
+// their current replicas and hands the ranges it loses to their next
+// replicas, then applies the weight. If the ranges it loses can't be handed
+// off the weight change is cancelled.
+func (n *Node) reweight() {
+	weight := n.Config.GetNode(n.Info.Name).NewWeight
+	n.streamGainedRanges()
+	moved := n.handOffRanges()
+	if moved != nil {
+		log.Errorf("Cancelling the weight change of %s: %s", n.Info.Name, moved)
+	}
+	err := n.UpdateConfig(func(cfg *Config) error {
+		self := cfg.GetNode(n.Info.Name)
+		if self == nil {
+			return errors.New(NODE_NOT_FOUND)
+		}
+		// Only the weight whose ranges were moved
+		if self.NewWeight != weight {
+			return nil
+		}
+		if moved == nil {
+			self.Weight = weight
+		}
+		self.NewWeight = 0
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Could not apply the new weight: %s", err)
+	} else if moved == nil {
+		log.Infof("%s now has weight %g", n.Info.Name, weight)
+	}
+	n.mu.Lock()
+	n.moving = false
+	n.mu.Unlock()
+}